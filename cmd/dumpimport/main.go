@@ -0,0 +1,94 @@
+// Command dumpimport loads Wikimedia pageview dump files from local disk into the API's storage, or into a snapshot
+// file that can be POSTed to /admin/snapshot. Usage:
+//
+//	dumpimport [flags] pageviews-20210101-*.gz ...
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"pelotechfun/constants"
+	"pelotechfun/importer"
+	"pelotechfun/storage"
+	"strings"
+)
+
+func main() {
+	projects := flag.String("projects", constants.DEFAULT_PROJECT, "comma separated projects to import, empty for every project in the dumps")
+	topN := flag.Int("top", importer.DEFAULT_TOP_N, "articles kept per project day, -1 for all of them")
+	backend := flag.String("storage", "file", "where to write: file, redis or snapshot")
+	dir := flag.String("dir", "data", "file storage directory")
+	redisAddr := flag.String("redis-addr", "localhost:6379", "redis server address")
+	redisPassword := flag.String("redis-password", "", "redis password")
+	redisDB := flag.Int("redis-db", 0, "redis database number")
+	redisPrefix := flag.String("redis-prefix", "", "redis key prefix, defaults to the API's")
+	allowPartialDays := flag.Bool("allow-partial-days", false, "write days missing some of their 24 hourly dumps")
+	snapshot := flag.String("snapshot", "snapshot.jsonl.gz", "snapshot file written by -storage snapshot")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] dumpfile.gz ...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	options := importer.Options{TopN: *topN, AllowPartialDays: *allowPartialDays}
+	if len(*projects) > 0 {
+		options.Projects = strings.Split(*projects, ",")
+	}
+	dumps := importer.New(options)
+	for _, path := range flag.Args() {
+		if err := dumps.ReadFile(path); err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("Read %s", path)
+	}
+	stats := dumps.Stats()
+	log.Infof("Read %d lines from %d files, skipped %d", stats.Lines, stats.Files, stats.Skipped)
+
+	ctx := context.Background()
+	var db storage.ContextStorage
+	var err error
+	switch *backend {
+	case "file":
+		db, err = storage.NewFileStorage(*dir)
+	case "redis":
+		db, err = storage.NewRedisStorage(ctx, storage.RedisOptions{
+			Addr:      *redisAddr,
+			Password:  *redisPassword,
+			DB:        *redisDB,
+			KeyPrefix: *redisPrefix,
+		})
+	case "snapshot":
+		db = storage.Adapt(storage.NewLocalMapStorage())
+	default:
+		err = fmt.Errorf("unknown storage %q (expected file, redis or snapshot)", *backend)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	written, err := dumps.Write(ctx, db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("Wrote %d day lists", written)
+
+	if *backend == "snapshot" {
+		file, err := os.Create(*snapshot)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if _, err = storage.Export(ctx, db, file); err != nil {
+			log.Fatal(err)
+		}
+		if err = file.Close(); err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("Wrote snapshot %s", *snapshot)
+	}
+}
@@ -0,0 +1,33 @@
+// Command pageviewstub serves a fake Wikimedia Pageviews API with deterministic synthetic data, for load tests and
+// offline runs. Point the app at it with WIKIAPI_PAGEVIEWS_URL. Usage:
+//
+//	pageviewstub [-addr :8090] [-seed 1] [-faults 20210101=404,20210102=503*2,20210103=2s]
+package main
+
+import (
+	"flag"
+	"github.com/go-chi/chi/v5/middleware"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"pelotechfun/pageviewstub"
+)
+
+func main() {
+	addr := flag.String("addr", ":8090", "address to listen on")
+	seed := flag.Int64("seed", 1, "picks the synthetic data set, the same seed always serves the same counts")
+	articles := flag.Int("articles", pageviewstub.DEFAULT_ARTICLES, "articles in each top list")
+	latency := flag.Duration("latency", 0, "delay added to every response, e.g. 50ms")
+	faults := flag.String("faults", "", "comma separated DAY=EFFECT faults, EFFECT being a status (404, 429, 503), a status for the first N requests (503*2) or a delay (2s)")
+	flag.Parse()
+
+	options := pageviewstub.Options{Seed: *seed, Articles: *articles, Latency: *latency}
+	var err error
+	if options.Faults, err = pageviewstub.ParseFaults(*faults); err != nil {
+		log.Fatal(err)
+	}
+	for _, fault := range options.Faults {
+		log.Infof("Injecting fault %s", fault)
+	}
+	log.Infof("Serving stub Pageviews API with seed %d on %s", *seed, *addr)
+	log.Fatal(http.ListenAndServe(*addr, middleware.Logger(pageviewstub.New(options))))
+}
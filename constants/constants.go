@@ -4,5 +4,33 @@ package constants
 const DATELAYOUT = "20060102"
 const TWODAYMONTH = "01"
 const TWODAYDAYOFWEEK = "02"
-const PAGEVIEWS_URL = "https://wikimedia.org/api/rest_v1/metrics/pageviews/top/en.wikipedia/all-access/%s/%s/%s"
+const PAGEVIEWS_BASE_URL = "https://wikimedia.org/api/rest_v1/metrics/pageviews"
+const PAGEVIEWS_TOP_PATH = "/top/%s/%s/%s/%s/%s"
+
+// per-article path takes project, access, article and start and end days. Views are for the "user" agent, as the top
+// lists are
+const PAGEVIEWS_PER_ARTICLE_PATH = "/per-article/%s/%s/user/%s/daily/%s/%s"
+
+// wiki project used when a request does not name one, so the original un-prefixed routes keep their meaning
+const DEFAULT_PROJECT = "en.wikipedia"
+
+// access methods the Pageviews API breaks views down by. ACCESS_ALL is the sum of the other three
+const ACCESS_ALL = "all-access"
+const ACCESS_DESKTOP = "desktop"
+const ACCESS_MOBILE_APP = "mobile-app"
+const ACCESS_MOBILE_WEB = "mobile-web"
+
+// access method used when a request does not name one
+const DEFAULT_ACCESS = ACCESS_ALL
+
+// Wikimedia's API etiquette asks clients to identify themselves with a way to contact the operator
+const DEFAULT_USER_AGENT = "ogury-wikiapi/1.0 (https://github.com/dilzio/ogury-wikiapi)"
 const MAXDAYINTERVAL = 100 //
+const DEFAULT_FETCH_CONCURRENCY = 10
+
+// default outbound rate limit for Wikimedia calls in requests/second and burst, comfortably under the published limits
+const DEFAULT_FETCH_RATE = 50.0
+const DEFAULT_FETCH_BURST = 10
+
+// instrumentation scope shared by every package that reports OTel metrics
+const METER_NAME = "article-stats-service"
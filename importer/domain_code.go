@@ -0,0 +1,64 @@
+package importer
+
+import (
+	"pelotechfun/constants"
+	"strings"
+)
+
+// projectSuffixes maps the abbreviations used in dump domain codes to the project family names used by the
+// Pageviews API. No suffix means wikipedia
+var projectSuffixes = map[string]string{
+	"":    "wikipedia",
+	"b":   "wikibooks",
+	"d":   "wiktionary",
+	"m":   "wikimedia",
+	"n":   "wikinews",
+	"q":   "wikiquote",
+	"s":   "wikisource",
+	"v":   "wikiversity",
+	"voy": "wikivoyage",
+	"w":   "mediawiki",
+	"wd":  "wikidata",
+}
+
+// Function ParseDomainCode maps a dump domain code to a Pageviews API project and access method. Codes are a
+// language (or site, e.g. commons) optionally followed by ".m" for the mobile site and then a project abbreviation:
+// "en" is en.wikipedia on desktop, "en.m" en.wikipedia on mobile-web, "de.m.d" de.wiktionary on mobile-web and
+// "commons.m" commons.wikimedia on desktop. Dumps don't separate app views, so mobile is always mobile-web. The bool
+// is false for codes that don't fit this pattern
+func ParseDomainCode(code string) (project string, access string, ok bool) {
+	parts := strings.Split(code, ".")
+	if len(parts) > 3 || len(parts[0]) == 0 {
+		return "", "", false
+	}
+	access = constants.ACCESS_DESKTOP
+	//m is both the mobile marker and the wikimedia abbreviation. On its own it means mobile except for wikimedia sites
+	if len(parts) == 3 || (len(parts) == 2 && parts[1] == "m" && !wikimediaSites[parts[0]]) {
+		if parts[1] != "m" {
+			return "", "", false
+		}
+		access = constants.ACCESS_MOBILE_WEB
+		parts = append(parts[:1], parts[2:]...)
+	}
+	suffix := ""
+	if len(parts) == 2 {
+		suffix = parts[1]
+	}
+	family, ok := projectSuffixes[suffix]
+	if !ok {
+		return "", "", false
+	}
+	return parts[0] + "." + family, access, true
+}
+
+// wikimediaSites are the sites whose domain codes end in the wikimedia abbreviation, e.g. "commons.m"
+var wikimediaSites = map[string]bool{
+	"commons":    true,
+	"meta":       true,
+	"species":    true,
+	"incubator":  true,
+	"outreach":   true,
+	"foundation": true,
+	"wikimania":  true,
+	"strategy":   true,
+}
@@ -0,0 +1,238 @@
+// Package importer loads the Wikimedia pageview dump files (https://dumps.wikimedia.org/other/pageviews/) into a
+// storage backend, so long historical ranges can be served without thousands of calls to the Pageviews API. Dumps
+// are gzip'd text files of space separated "domain_code page_title count_views total_response_size" lines, one file
+// per hour (or per day for pre-aggregated dumps)
+package importer
+
+import (
+	"bufio"
+	"cmp"
+	"compress/gzip"
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"pelotechfun/constants"
+	"pelotechfun/messages"
+	"pelotechfun/storage"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// number of articles kept per day by default, matching the Pageviews API top endpoint
+const DEFAULT_TOP_N = 1000
+
+// Type Options tunes an Importer
+type Options struct {
+	// Projects limits the import to these projects, e.g. "en.wikipedia". Empty imports every project in the dumps,
+	// which needs a lot of memory for a full day
+	Projects []string
+	// TopN is how many articles are kept per project day, most viewed first. Defaults to DEFAULT_TOP_N. Negative keeps
+	// every article, so per-article queries for the imported days never need the API
+	TopN int
+	// AllowPartialDays writes days that not all 24 hourly dumps were read for. Their lists undercount the day yet
+	// overwrite whatever the store has, e.g. a complete day from the API, so by default such days are skipped
+	AllowPartialDays bool
+}
+
+// Type Stats counts what an Importer has read so far
+type Stats struct {
+	Files int
+	Lines int
+	// Skipped lines were malformed or for projects not being imported
+	Skipped int
+}
+
+// Type Importer aggregates dump files in memory and writes the result to storage. Files for the same day (e.g. its 24
+// hourly dumps) are summed. Not safe for concurrent use
+type Importer struct {
+	options  Options
+	projects map[string]bool
+	counts   map[storage.Key]map[string]int
+	// hours records which hours of each day have been read, as a bit per hour
+	hours map[time.Time]uint32
+	stats Stats
+}
+
+// all 24 hours of a day read
+const wholeDay = 1<<24 - 1
+
+// Function New creates an empty Importer
+func New(options Options) *Importer {
+	if options.TopN == 0 {
+		options.TopN = DEFAULT_TOP_N
+	}
+	projects := make(map[string]bool, len(options.Projects))
+	for _, project := range options.Projects {
+		projects[project] = true
+	}
+	return &Importer{
+		options:  options,
+		projects: projects,
+		counts:   make(map[storage.Key]map[string]int),
+		hours:    make(map[time.Time]uint32),
+	}
+}
+
+// dumpDay finds the day, and the hour of hourly dumps, in a dump file name such as pageviews-20210101-130000.gz
+var dumpDay = regexp.MustCompile(`(\d{8})(?:-(\d{2})\d{4})?\.gz$`)
+
+// ReadFile reads a gzip'd dump file, taking its day and hour from the file name. A name without an hour is a whole
+// day's dump
+func (i *Importer) ReadFile(path string) error {
+	match := dumpDay.FindStringSubmatch(filepath.Base(path))
+	if match == nil {
+		return fmt.Errorf("%s: no YYYYMMDD day in the file name", path)
+	}
+	day, err := time.Parse(constants.DATELAYOUT, match[1])
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if len(match[2]) == 0 {
+		err = i.Read(day, file)
+	} else {
+		hour, _ := strconv.Atoi(match[2])
+		err = i.ReadHour(day, hour, file)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// Read reads a gzip'd dump holding a whole day's views. Malformed lines are counted as skipped rather than failing the
+// read
+func (i *Importer) Read(day time.Time, r io.Reader) error {
+	return i.read(day, wholeDay, r)
+}
+
+// ReadHour reads a gzip'd hourly dump holding views for hour (0-23) of day
+func (i *Importer) ReadHour(day time.Time, hour int, r io.Reader) error {
+	if hour < 0 || hour > 23 {
+		return fmt.Errorf("bad hour %d", hour)
+	}
+	return i.read(day, 1<<hour, r)
+}
+
+// read reads a gzip'd dump holding views for the hours of day set in hours. Reading an hour twice would count its
+// views twice, so it fails
+func (i *Importer) read(day time.Time, hours uint32, r io.Reader) error {
+	day = day.Truncate(storage.TRUNCATE_TO_DAY)
+	if i.hours[day]&hours != 0 {
+		return fmt.Errorf("hours of %s read twice", day.Format(constants.DATELAYOUT))
+	}
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("dump is not gzip'd: %w", err)
+	}
+	defer zr.Close()
+	scanner := bufio.NewScanner(zr)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		i.stats.Lines++
+		if !i.add(day, scanner.Text()) {
+			i.stats.Skipped++
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return fmt.Errorf("reading dump: %w", err)
+	}
+	i.hours[day] |= hours
+	i.stats.Files++
+	return nil
+}
+
+// add counts one dump line, reporting whether it was used
+func (i *Importer) add(day time.Time, line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return false
+	}
+	project, access, ok := ParseDomainCode(fields[0])
+	if !ok || (len(i.projects) > 0 && !i.projects[project]) {
+		return false
+	}
+	views, err := strconv.Atoi(fields[2])
+	if err != nil || views < 0 {
+		return false
+	}
+	title := fields[1]
+	if title == "-" {
+		return false
+	}
+	//all-access is kept alongside the per-method lists, as the API does
+	for _, key := range []storage.Key{storage.NewKey(project, access, day), storage.NewKey(project, constants.ACCESS_ALL, day)} {
+		articles, ok := i.counts[key]
+		if !ok {
+			articles = make(map[string]int)
+			i.counts[key] = articles
+		}
+		articles[title] += views
+	}
+	return true
+}
+
+// Stats reports what has been read so far
+func (i *Importer) Stats() Stats {
+	return i.stats
+}
+
+// Write stores a top list for every project, access method and day read, overwriting any the store already has.
+// Days that not all hours were read for are skipped with a warning, unless Options.AllowPartialDays is set when they
+// are written with one. Returns the number of lists written
+func (i *Importer) Write(ctx context.Context, s storage.ContextStorage) (int, error) {
+	for day, hours := range i.hours {
+		if hours == wholeDay {
+			continue
+		}
+		if i.options.AllowPartialDays {
+			log.Warnf("Writing %s from %d of its 24 hourly dumps, so its counts are short", day.Format(constants.DATELAYOUT), bits.OnesCount32(hours))
+		} else {
+			log.Warnf("Skipping %s, only %d of its 24 hourly dumps were read", day.Format(constants.DATELAYOUT), bits.OnesCount32(hours))
+		}
+	}
+	keys := make([]storage.Key, 0, len(i.counts))
+	for key := range i.counts {
+		if i.hours[key.Day] == wholeDay || i.options.AllowPartialDays {
+			keys = append(keys, key)
+		}
+	}
+	slices.SortFunc(keys, func(a, b storage.Key) int {
+		return cmp.Compare(a.String(), b.String())
+	})
+	for written, key := range keys {
+		if err := s.Put(ctx, key, i.topList(i.counts[key])); err != nil {
+			return written, fmt.Errorf("writing %s: %w", key, err)
+		}
+	}
+	return len(keys), nil
+}
+
+// topList ranks a day's articles by views, ties broken by name so imports are repeatable
+func (i *Importer) topList(articles map[string]int) []messages.ArticleCount {
+	counts := make([]messages.ArticleCount, 0, len(articles))
+	for name, views := range articles {
+		counts = append(counts, messages.ArticleCount{Name: name, Views: views})
+	}
+	slices.SortFunc(counts, func(a, b messages.ArticleCount) int {
+		if a.Views != b.Views {
+			return cmp.Compare(b.Views, a.Views)
+		}
+		return cmp.Compare(a.Name, b.Name)
+	})
+	if i.options.TopN > 0 && len(counts) > i.options.TopN {
+		counts = counts[:i.options.TopN]
+	}
+	return counts
+}
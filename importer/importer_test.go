@@ -0,0 +1,136 @@
+package importer
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"pelotechfun/constants"
+	"pelotechfun/messages"
+	"pelotechfun/storage"
+	"testing"
+	"time"
+)
+
+// Hourly fixture dumps for the same day are summed into per project, access method and day top lists. The fixtures
+// are a few hours of each day, so partial days must be allowed
+func Test_Importer_Fixtures(t *testing.T) {
+	ctx := context.Background()
+	underTest := New(Options{AllowPartialDays: true})
+	files, _ := filepath.Glob("testdata/pageviews-*.gz")
+	assert.Equal(t, 3, len(files))
+	for _, file := range files {
+		assert.Nil(t, underTest.ReadFile(file))
+	}
+	assert.Equal(t, Stats{Files: 3, Lines: 21, Skipped: 4}, underTest.Stats())
+
+	db := storage.Adapt(storage.NewLocalMapStorage())
+	written, err := underTest.Write(ctx, db)
+	assert.Nil(t, err)
+	//en.wikipedia and de.wikipedia x3, de.wiktionary and commons.wikimedia x2 on the 1st, en.wikipedia x2 on the 2nd
+	assert.Equal(t, 12, written)
+
+	day, _ := time.Parse(constants.DATELAYOUT, "20210101")
+	counts, found, err := db.Get(ctx, storage.NewKey("en.wikipedia", constants.ACCESS_ALL, day))
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, []messages.ArticleCount{
+		{Name: "Main_Page", Views: 3900},
+		{Name: "Special:Search", Views: 550},
+		{Name: "Dua_Lipa", Views: 180},
+	}, counts)
+	counts, _, _ = db.Get(ctx, storage.NewKey("en.wikipedia", constants.ACCESS_MOBILE_WEB, day))
+	assert.Equal(t, []messages.ArticleCount{{Name: "Main_Page", Views: 1700}, {Name: "Dua_Lipa", Views: 90}}, counts)
+	counts, _, _ = db.Get(ctx, storage.NewKey("de.wiktionary", constants.ACCESS_MOBILE_WEB, day))
+	assert.Equal(t, []messages.ArticleCount{{Name: "Haus", Views: 7}}, counts)
+	counts, _, _ = db.Get(ctx, storage.NewKey("commons.wikimedia", constants.ACCESS_DESKTOP, day))
+	assert.Equal(t, []messages.ArticleCount{{Name: "Main_Page", Views: 90}}, counts)
+	counts, _, _ = db.Get(ctx, storage.NewKey("en.wikipedia", constants.ACCESS_DESKTOP, day.AddDate(0, 0, 1)))
+	assert.Equal(t, []messages.ArticleCount{{Name: "Main_Page", Views: 2000}, {Name: "Dua_Lipa", Views: 5}}, counts)
+}
+
+// Only the requested projects are kept, and lists are cut to TopN
+func Test_Importer_Options(t *testing.T) {
+	underTest := New(Options{Projects: []string{"en.wikipedia"}, TopN: 1, AllowPartialDays: true})
+	assert.Nil(t, underTest.ReadFile("testdata/pageviews-20210101-000000.gz"))
+	db := storage.Adapt(storage.NewLocalMapStorage())
+	written, err := underTest.Write(context.Background(), db)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, written)
+	day, _ := time.Parse(constants.DATELAYOUT, "20210101")
+	counts, _, _ := db.Get(context.Background(), storage.NewKey("en.wikipedia", constants.ACCESS_ALL, day))
+	assert.Equal(t, []messages.ArticleCount{{Name: "Main_Page", Views: 2000}}, counts)
+
+	assert.NotNil(t, underTest.ReadFile("testdata/no-day-in-name.gz"))
+	assert.NotNil(t, underTest.Read(day, bytes.NewReader([]byte("not gzip"))))
+}
+
+// Days missing some of their hourly dumps are not written unless allowed, so they never replace complete days
+func Test_Importer_PartialDays(t *testing.T) {
+	ctx := context.Background()
+	day, _ := time.Parse(constants.DATELAYOUT, "20210101")
+	complete := []messages.ArticleCount{{Name: "Main_Page", Views: 999999}}
+	db := storage.Adapt(storage.NewLocalMapStorage())
+	assert.Nil(t, db.Put(ctx, storage.NewKey("en.wikipedia", constants.ACCESS_ALL, day), complete))
+
+	underTest := New(Options{Projects: []string{"en.wikipedia"}})
+	assert.Nil(t, underTest.ReadFile("testdata/pageviews-20210101-000000.gz"))
+	written, err := underTest.Write(ctx, db)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, written)
+	counts, _, _ := db.Get(ctx, storage.NewKey("en.wikipedia", constants.ACCESS_ALL, day))
+	assert.Equal(t, complete, counts)
+
+	//an hour read twice would be counted twice
+	assert.NotNil(t, underTest.ReadFile("testdata/pageviews-20210101-000000.gz"))
+
+	//once every hour is read the day is complete
+	hour, err := os.ReadFile("testdata/pageviews-20210101-010000.gz")
+	assert.Nil(t, err)
+	for h := 1; h < 24; h++ {
+		assert.Nil(t, underTest.ReadHour(day, h, bytes.NewReader(hour)))
+	}
+	written, err = underTest.Write(ctx, db)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, written)
+	counts, _, _ = db.Get(ctx, storage.NewKey("en.wikipedia", constants.ACCESS_ALL, day))
+	assert.NotEqual(t, complete, counts)
+
+	//as is a whole day's dump
+	underTest = New(Options{Projects: []string{"en.wikipedia"}})
+	assert.Nil(t, underTest.Read(day, bytes.NewReader(hour)))
+	written, err = underTest.Write(ctx, db)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, written)
+	assert.NotNil(t, underTest.ReadHour(day, 5, bytes.NewReader(hour)))
+}
+
+func Test_ParseDomainCode(t *testing.T) {
+	tests := []struct {
+		code    string
+		project string
+		access  string
+		ok      bool
+	}{
+		{"en", "en.wikipedia", constants.ACCESS_DESKTOP, true},
+		{"en.m", "en.wikipedia", constants.ACCESS_MOBILE_WEB, true},
+		{"de.d", "de.wiktionary", constants.ACCESS_DESKTOP, true},
+		{"de.m.d", "de.wiktionary", constants.ACCESS_MOBILE_WEB, true},
+		{"en.voy", "en.wikivoyage", constants.ACCESS_DESKTOP, true},
+		{"www.wd", "www.wikidata", constants.ACCESS_DESKTOP, true},
+		{"commons.m", "commons.wikimedia", constants.ACCESS_DESKTOP, true},
+		{"commons.m.m", "commons.wikimedia", constants.ACCESS_MOBILE_WEB, true},
+		{"en.x", "", "", false},
+		{"en.z.d", "", "", false},
+		{"", "", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.code, func(t *testing.T) {
+			project, access, ok := ParseDomainCode(test.code)
+			assert.Equal(t, test.ok, ok)
+			assert.Equal(t, test.project, project)
+			assert.Equal(t, test.access, access)
+		})
+	}
+}
@@ -0,0 +1,396 @@
+package indexer
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/zavitax/sortedset-go"
+	"pelotechfun/constants"
+	"pelotechfun/messages"
+	"pelotechfun/storage"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Type DayIterator calls yield with each day a query covers, in date order, until yield returns false. It has the
+// shape of an iter.Seq[time.Time]
+type DayIterator func(yield func(day time.Time) bool)
+
+// Function DaysBetween iterates the days from startdate to enddate inclusive
+func DaysBetween(startdate time.Time, enddate time.Time) DayIterator {
+	return func(yield func(day time.Time) bool) {
+		for d := startdate; !d.After(enddate); d = d.AddDate(0, 0, 1) {
+			if !yield(d) {
+				return
+			}
+		}
+	}
+}
+
+// collect lists the days it iterates
+func (it DayIterator) collect() []time.Time {
+	days := []time.Time{}
+	it(func(day time.Time) bool {
+		days = append(days, day)
+		return true
+	})
+	return days
+}
+
+// Type DayFilter picks which of a day's article counts a query aggregates
+type DayFilter func(day time.Time, count messages.ArticleCount) bool
+
+// Type Reducer folds the counts an article has on each day of a query into one count
+type Reducer struct {
+	// fold adds the count for day to acc, the article's result so far. first is true for the article's first day
+	fold func(acc messages.ArticleCount, count messages.ArticleCount, day time.Time, first bool) messages.ArticleCount
+	// finish, when set, turns acc into the result once every day has been folded in. days is how many were
+	finish func(acc messages.ArticleCount, days int) messages.ArticleCount
+}
+
+var (
+	//Var Sum totals an article's views over the days
+	Sum = Reducer{fold: func(acc messages.ArticleCount, count messages.ArticleCount, day time.Time, first bool) messages.ArticleCount {
+		if first {
+			return messages.ArticleCount{Name: count.Name, Views: count.Views}
+		}
+		acc.Views = acc.Views + count.Views
+		return acc
+	}}
+	//Var Max keeps an article's most viewed day, with Date set. Ties go to the earliest day
+	Max = Reducer{fold: func(acc messages.ArticleCount, count messages.ArticleCount, day time.Time, first bool) messages.ArticleCount {
+		if first || count.Views > acc.Views {
+			return messages.ArticleCount{Name: count.Name, Views: count.Views, Date: day}
+		}
+		return acc
+	}}
+	//Var Min keeps an article's least viewed day, with Date set. Ties go to the earliest day
+	Min = Reducer{fold: func(acc messages.ArticleCount, count messages.ArticleCount, day time.Time, first bool) messages.ArticleCount {
+		if first || count.Views < acc.Views {
+			return messages.ArticleCount{Name: count.Name, Views: count.Views, Date: day}
+		}
+		return acc
+	}}
+	//Var Mean averages an article's views over the days it has counts for, rounded to the nearest view
+	Mean = Reducer{fold: Sum.fold, finish: func(acc messages.ArticleCount, days int) messages.ArticleCount {
+		acc.Views = (2*acc.Views + days) / (2 * days)
+		return acc
+	}}
+	//Var CountDays counts the days an article has counts for
+	CountDays = Reducer{fold: Sum.fold, finish: func(acc messages.ArticleCount, days int) messages.ArticleCount {
+		acc.Views = days
+		return acc
+	}}
+)
+
+// Type Query declares a range aggregation for Aggregate: which days of which top lists to read, which counts to keep
+// and how to reduce each article's counts
+type Query struct {
+	Project string
+	Access  string
+	Days    DayIterator
+	// Filter, when set, drops counts it returns false for before they are reduced
+	Filter DayFilter
+	Reduce Reducer
+	// Article, when set, limits the query to that article. If it is missing from the top lists on any day, the whole
+	// query is answered from its per-article series instead, so no day is left out
+	Article string
+	// Partial answers from the days that could be read rather than failing when some can't
+	Partial bool
+	// Page picks which of the ranked results to return. The zero Page returns them all
+	Page Page
+	// Series returns a count per day in date order, with Date set, instead of a ranking: the views that pass the filter
+	// that day, named Article. Reduce and Page are ignored. Days Wikipedia has no data for don't fail the query but
+	// are counts marked Missing, as are the days a Partial query leaves out
+	Series bool
+}
+
+// Type Page picks a slice of a ranking: Limit results (all of them when zero) starting after Cursor, a Result.Next from
+// the previous page, or else after the first Offset
+type Page struct {
+	Offset int
+	Limit  int
+	Cursor string
+}
+
+// Type Result is a query's page of results
+type Result struct {
+	// Counts are the results on the page, most viewed first
+	Counts []messages.ArticleCount
+	// Total is the number of results over all pages
+	Total int
+	// Next is the cursor of the page after this one, empty when this is the last page
+	Next string
+	// Missing are the days a Partial query left out, in date order
+	Missing []time.Time
+}
+
+// ErrBadCursor is returned for a page cursor that wasn't issued for the query's results, e.g. because the ranking
+// changed after a partial result or it was made up
+var ErrBadCursor = errors.New("invalid or expired page cursor")
+
+// Function Aggregate runs q: it reads every day's top list concurrently through the day cache, reduces the counts
+// that pass the filter per article in date order, and returns q's page of the results ranked by views, most viewed
+// first. Any day failing fails the query, since its results would be wrong, unless q is Partial: then the days that
+// could be read are aggregated and the rest are returned as missing, in date order. Once ctx is done outstanding
+// fetches are abandoned and the query fails with ctx's error, wrapped in ErrTimeout if its deadline passed
+func Aggregate(ctx context.Context, q Query) (Result, error) {
+	allDays := q.Days.collect()
+	countsByDay, errs := getArticleCountsForDays(ctx, q.Project, q.Access, allDays)
+	noData := make(map[time.Time]bool)
+	if q.Series {
+		for i, dayErr := range errs {
+			if errors.Is(dayErr, ErrNoData) {
+				noData[allDays[i]] = true
+				errs[i] = nil
+			}
+		}
+	}
+	days, countsByDay, missing, err := skipFailedDays(ctx, q.Partial, allDays, countsByDay, errs)
+	if err != nil {
+		return Result{}, err
+	}
+	if len(noData) > 0 {
+		//there is nothing more to find out about days without data, so they are left out like missing ones
+		days, countsByDay = withoutDays(days, countsByDay, noData)
+	}
+	if len(q.Article) > 0 {
+		countsByDay = onlyArticle(countsByDay, q.Article)
+		if slices.ContainsFunc(countsByDay, func(counts []messages.ArticleCount) bool { return len(counts) == 0 }) {
+			//the article fell out of the top lists on some days, so its result would be short. Use its own series instead
+			series, err := getArticleSeries(ctx, q.Project, q.Access, q.Article, days[0], days[len(days)-1])
+			switch {
+			case err == nil:
+				countsByDay = seriesByDay(days, series)
+			case q.Partial && ctx.Err() == nil:
+				//without the series only the days the article made the top lists are known
+				log.Warnf("Leaving out days %s is missing from the top lists: %v", q.Article, err)
+				errs = make([]error, len(days))
+				for i, counts := range countsByDay {
+					if len(counts) == 0 {
+						errs[i] = err
+					}
+				}
+				var alsoMissing []time.Time
+				if days, countsByDay, alsoMissing, err = skipFailedDays(ctx, true, days, countsByDay, errs); err != nil {
+					return Result{}, err
+				}
+				missing = mergeDays(missing, alsoMissing)
+			default:
+				return Result{}, queryError(ctx, err)
+			}
+		}
+	}
+	if q.Series {
+		return Result{Counts: daySeries(q.Article, allDays, days, countsByDay, q.Filter), Missing: missing}, nil
+	}
+	results := reduce(days, countsByDay, q.Filter, q.Reduce)
+	result, err := rank(results, q.Page)
+	result.Missing = missing
+	return result, err
+}
+
+// Function skipFailedDays checks the outcome of reading days. Strictly any error fails the query; partially the days
+// that failed are dropped and returned as missing, unless ctx is done or no day could be read at all
+func skipFailedDays(ctx context.Context, partial bool, days []time.Time, countsByDay [][]messages.ArticleCount, errs []error) ([]time.Time, [][]messages.ArticleCount, []time.Time, error) {
+	err := errors.Join(errs...)
+	if err == nil {
+		return days, countsByDay, nil, nil
+	}
+	failed := 0
+	for _, dayErr := range errs {
+		if dayErr != nil {
+			failed++
+		}
+	}
+	if !partial || ctx.Err() != nil || failed == len(days) {
+		return nil, nil, nil, queryError(ctx, err)
+	}
+	keptDays := make([]time.Time, 0, len(days)-failed)
+	keptCounts := make([][]messages.ArticleCount, 0, len(days)-failed)
+	missing := make([]time.Time, 0, failed)
+	for i, day := range days {
+		if errs[i] != nil {
+			log.Warnf("Leaving out %s from a partial result: %v", day.Format(constants.DATELAYOUT), errs[i])
+			missing = append(missing, day)
+			continue
+		}
+		keptDays = append(keptDays, day)
+		keptCounts = append(keptCounts, countsByDay[i])
+	}
+	return keptDays, keptCounts, missing, nil
+}
+
+// Function withoutDays drops the days in drop, along with their counts
+func withoutDays(days []time.Time, countsByDay [][]messages.ArticleCount, drop map[time.Time]bool) ([]time.Time, [][]messages.ArticleCount) {
+	keptDays := make([]time.Time, 0, len(days))
+	keptCounts := make([][]messages.ArticleCount, 0, len(days))
+	for i, day := range days {
+		if !drop[day] {
+			keptDays = append(keptDays, day)
+			keptCounts = append(keptCounts, countsByDay[i])
+		}
+	}
+	return keptDays, keptCounts
+}
+
+// Function mergeDays merges two date ordered lists of days into one, without duplicates
+func mergeDays(a []time.Time, b []time.Time) []time.Time {
+	merged := append(slices.Clone(a), b...)
+	slices.SortFunc(merged, func(x, y time.Time) int { return x.Compare(y) })
+	return slices.CompactFunc(merged, func(x, y time.Time) bool { return x.Equal(y) })
+}
+
+// Function getArticleCountsForDays concurrently reads each day's top list through getArticleCountsForDay. Returns
+// the lists and errors in the order of days
+func getArticleCountsForDays(ctx context.Context, project string, access string, days []time.Time) ([][]messages.ArticleCount, []error) {
+	countsByDay := make([][]messages.ArticleCount, len(days))
+	errs := make([]error, len(days))
+	wg := sync.WaitGroup{}
+	//each goroutine only touches its own day, so no locking is needed
+	for i, day := range days {
+		wg.Add(1)
+		go func(i int, date time.Time) {
+			defer wg.Done()
+			countsByDay[i], errs[i] = getArticleCountsForDay(ctx, storage.NewKey(project, access, date))
+			if errs[i] != nil {
+				log.Debugf("Unable to retrieve data for date: %v", date)
+			}
+		}(i, day)
+	}
+	wg.Wait()
+	return countsByDay, errs
+}
+
+// Function onlyArticle narrows each day's counts down to article's
+func onlyArticle(countsByDay [][]messages.ArticleCount, article string) [][]messages.ArticleCount {
+	narrowed := make([][]messages.ArticleCount, len(countsByDay))
+	for i, counts := range countsByDay {
+		for _, countobject := range counts {
+			if countobject.Name == article {
+				narrowed[i] = []messages.ArticleCount{countobject}
+				break
+			}
+		}
+	}
+	return narrowed
+}
+
+// Function seriesByDay lines an article's per-article series up with days. Days the series has no views for are empty
+func seriesByDay(days []time.Time, series []messages.ArticleCount) [][]messages.ArticleCount {
+	viewsByDay := make(map[string]messages.ArticleCount, len(series))
+	for _, countobject := range series {
+		viewsByDay[countobject.Date.Format(constants.DATELAYOUT)] = countobject
+	}
+	countsByDay := make([][]messages.ArticleCount, len(days))
+	for i, day := range days {
+		if countobject, ok := viewsByDay[day.Format(constants.DATELAYOUT)]; ok {
+			countsByDay[i] = []messages.ArticleCount{countobject}
+		}
+	}
+	return countsByDay
+}
+
+// Function reduce folds each day's counts that keep accepts into a result per article, days in order
+func reduce(days []time.Time, countsByDay [][]messages.ArticleCount, keep DayFilter, reducer Reducer) map[string]messages.ArticleCount {
+	results := make(map[string]messages.ArticleCount)
+	daysFound := make(map[string]int)
+	for i, day := range days {
+		for _, countobject := range countsByDay[i] {
+			if keep != nil && !keep(day, countobject) {
+				continue
+			}
+			acc, ok := results[countobject.Name]
+			results[countobject.Name] = reducer.fold(acc, countobject, day, !ok)
+			daysFound[countobject.Name]++
+		}
+	}
+	if reducer.finish != nil {
+		for name, acc := range results {
+			results[name] = reducer.finish(acc, daysFound[name])
+		}
+	}
+	return results
+}
+
+// Function daySeries lays out a count named name for each of allDays, summing the views keep accepts on each of days,
+// a date ordered subset of them. The other days are marked Missing
+func daySeries(name string, allDays []time.Time, days []time.Time, countsByDay [][]messages.ArticleCount, keep DayFilter) []messages.ArticleCount {
+	series := make([]messages.ArticleCount, len(allDays))
+	next := 0
+	for i, day := range allDays {
+		series[i] = messages.ArticleCount{Name: name, Date: day}
+		if next == len(days) || !days[next].Equal(day) {
+			series[i].Missing = true
+			continue
+		}
+		for _, countobject := range countsByDay[next] {
+			if keep == nil || keep(day, countobject) {
+				series[i].Views = series[i].Views + countobject.Views
+			}
+		}
+		next++
+	}
+	return series
+}
+
+// Function rank orders results by views, most viewed first, and returns page of them
+func rank(results map[string]messages.ArticleCount, page Page) (Result, error) {
+	index := sortedset.New[string, int, messages.ArticleCount]()
+	for name, countobject := range results {
+		index.AddOrUpdate(name, countobject.Views, countobject)
+	}
+	total := index.GetCount()
+	result := Result{Total: total}
+	//positions count from 1 for the most viewed, i.e. rank -1 of the set, which sorts ascending
+	after := page.Offset
+	if len(page.Cursor) > 0 {
+		var err error
+		if after, err = cursorPosition(index, page.Cursor); err != nil {
+			return Result{}, err
+		}
+	}
+	//checked before adding to, so a huge offset can't overflow
+	if after >= total {
+		return result, nil
+	}
+	first := after + 1
+	last := total
+	//compared against what is left rather than added to first, so a huge limit can't overflow
+	if page.Limit > 0 && page.Limit <= total-first {
+		last = first + page.Limit - 1
+	}
+	for _, node := range index.GetRangeByRank(-first, -last, false) {
+		result.Counts = append(result.Counts, node.Value)
+	}
+	if last < total {
+		result.Next = encodeCursor(result.Counts[len(result.Counts)-1])
+	}
+	return result, nil
+}
+
+// Function encodeCursor makes the cursor of the page following the one ending with last. It records last's name and
+// views, which place it in the ranking
+func encodeCursor(last messages.ArticleCount) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(last.Views) + ":" + last.Name))
+}
+
+// Function cursorPosition finds the position in index of the article a cursor ends on, counting from 1 for the most
+// viewed
+func cursorPosition(index *sortedset.SortedSet[string, int, messages.ArticleCount], cursor string) (int, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, ErrBadCursor
+	}
+	viewsstr, name, ok := strings.Cut(string(decoded), ":")
+	views, err := strconv.Atoi(viewsstr)
+	node := index.GetByKey(name)
+	if !ok || err != nil || node == nil || node.Score() != views {
+		return 0, ErrBadCursor
+	}
+	return index.GetCount() - index.FindRank(name) + 1, nil
+}
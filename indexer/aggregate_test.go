@@ -0,0 +1,295 @@
+package indexer
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"pelotechfun/constants"
+	"pelotechfun/messages"
+	"pelotechfun/storage"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stubDays serves the given top lists for consecutive days from 20210101, and 404s after them
+func stubDays(t *testing.T, lists ...[]messages.ArticleCount) time.Time {
+	start, _ := time.Parse(constants.DATELAYOUT, "20210101")
+	DB = storage.Adapt(storage.NewLocalMapStorage())
+	Fetcher = func(ctx context.Context, key storage.Key) ([]messages.ArticleCount, error) {
+		i := int(key.Day.Sub(start).Hours() / 24)
+		if i < 0 || i >= len(lists) {
+			return nil, &FetchError{Project: key.Project, Access: key.Access, Date: key.Day, Err: ErrNoData}
+		}
+		return lists[i], nil
+	}
+	return start
+}
+
+func Test_Aggregate_Reducers(t *testing.T) {
+	start := stubDays(t,
+		[]messages.ArticleCount{{Name: "A", Views: 10}, {Name: "B", Views: 7}},
+		[]messages.ArticleCount{{Name: "A", Views: 30}, {Name: "C", Views: 1}},
+		[]messages.ArticleCount{{Name: "A", Views: 30}, {Name: "B", Views: 2}, {Name: "C", Views: 60}},
+	)
+	day := func(i int) time.Time { return start.AddDate(0, 0, i) }
+	tests := []struct {
+		name   string
+		reduce Reducer
+		want   []messages.ArticleCount
+	}{
+		{name: "sum", reduce: Sum, want: []messages.ArticleCount{{Name: "A", Views: 70}, {Name: "C", Views: 61}, {Name: "B", Views: 9}}},
+		{name: "max, ties to the earliest day", reduce: Max,
+			want: []messages.ArticleCount{{Name: "C", Views: 60, Date: day(2)}, {Name: "A", Views: 30, Date: day(1)}, {Name: "B", Views: 7, Date: day(0)}}},
+		{name: "min", reduce: Min,
+			want: []messages.ArticleCount{{Name: "A", Views: 10, Date: day(0)}, {Name: "B", Views: 2, Date: day(2)}, {Name: "C", Views: 1, Date: day(1)}}},
+		{name: "mean over days present, rounded", reduce: Mean,
+			want: []messages.ArticleCount{{Name: "C", Views: 31}, {Name: "A", Views: 23}, {Name: "B", Views: 5}}},
+		{name: "count of days", reduce: CountDays,
+			want: []messages.ArticleCount{{Name: "A", Views: 3}, {Name: "C", Views: 2}, {Name: "B", Views: 2}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := Aggregate(context.Background(), Query{
+				Project: constants.DEFAULT_PROJECT,
+				Access:  constants.DEFAULT_ACCESS,
+				Days:    DaysBetween(start, day(2)),
+				Reduce:  test.reduce,
+			})
+			assert.Nil(t, err)
+			assert.Equal(t, test.want, result.Counts)
+		})
+	}
+}
+
+// New queries are declared from a day iterator and a filter, e.g. the mean of weekdays only for some articles
+func Test_Aggregate_DaysAndFilter(t *testing.T) {
+	lists := make([][]messages.ArticleCount, 14)
+	for i := range lists {
+		lists[i] = []messages.ArticleCount{{Name: "Talk:A", Views: 1000}, {Name: "A", Views: i}, {Name: "B", Views: 100}}
+	}
+	start := stubDays(t, lists...)
+	weekdays := func(yield func(day time.Time) bool) {
+		DaysBetween(start, start.AddDate(0, 0, 13))(func(day time.Time) bool {
+			return day.Weekday() == time.Saturday || day.Weekday() == time.Sunday || yield(day)
+		})
+	}
+	result, err := Aggregate(context.Background(), Query{
+		Project: constants.DEFAULT_PROJECT,
+		Access:  constants.DEFAULT_ACCESS,
+		Days:    weekdays,
+		Filter: func(day time.Time, count messages.ArticleCount) bool {
+			return !strings.HasPrefix(count.Name, "Talk:")
+		},
+		Reduce: Sum,
+	})
+	assert.Nil(t, err)
+	//20210101 is a Friday: weekdays are the 1st, 4th-8th and 11th-14th, i.e. offsets 0, 3-7 and 10-13
+	assert.Equal(t, []messages.ArticleCount{{Name: "B", Views: 1000}, {Name: "A", Views: 71}}, result.Counts)
+
+	//an iterator that stops early reads no further days
+	_, err = Aggregate(context.Background(), Query{
+		Project: constants.DEFAULT_PROJECT,
+		Access:  constants.DEFAULT_ACCESS,
+		Days: func(yield func(day time.Time) bool) {
+			DaysBetween(start, start.AddDate(1, 0, 0))(func(day time.Time) bool {
+				return day.Before(start.AddDate(0, 0, 14)) && yield(day)
+			})
+		},
+		Reduce: Sum,
+	})
+	assert.Nil(t, err)
+
+	//any failing day fails the query
+	_, err = Aggregate(context.Background(), Query{
+		Project: constants.DEFAULT_PROJECT,
+		Access:  constants.DEFAULT_ACCESS,
+		Days:    DaysBetween(start, start.AddDate(0, 0, 14)),
+		Reduce:  Sum,
+	})
+	assert.ErrorIs(t, err, ErrNoData)
+
+	//no days, no results
+	result, err = Aggregate(context.Background(), Query{Days: DaysBetween(start, start.AddDate(0, 0, -1)), Reduce: Max, Article: "A"})
+	assert.Nil(t, err)
+	assert.Empty(t, result.Counts)
+}
+
+// A filter dropping an article on some days doesn't send an article query to the per-article series: only missing
+// from the top lists does
+func Test_Aggregate_ArticleFallback(t *testing.T) {
+	start := stubDays(t,
+		[]messages.ArticleCount{{Name: "A", Views: 5}},
+		[]messages.ArticleCount{{Name: "A", Views: 50}},
+	)
+	seriesCalls := 0
+	ArticleFetcher = func(ctx context.Context, project string, access string, article string, startdate time.Time, enddate time.Time) ([]messages.ArticleCount, error) {
+		seriesCalls++
+		return []messages.ArticleCount{{Name: article, Views: 3, Date: startdate}, {Name: article, Views: 4, Date: enddate}}, nil
+	}
+	defer func() { ArticleFetcher = NewWikipediaFetcher(WikipediaFetcherConfig{}).FetchArticle }()
+	query := Query{
+		Project: constants.DEFAULT_PROJECT,
+		Access:  constants.DEFAULT_ACCESS,
+		Days:    DaysBetween(start, start.AddDate(0, 0, 1)),
+		Filter: func(day time.Time, count messages.ArticleCount) bool {
+			return count.Views >= 10
+		},
+		Reduce:  CountDays,
+		Article: "A",
+	}
+	result, err := Aggregate(context.Background(), query)
+	assert.Nil(t, err)
+	assert.Equal(t, []messages.ArticleCount{{Name: "A", Views: 1}}, result.Counts)
+	assert.Equal(t, 0, seriesCalls)
+
+	query.Article, query.Filter, query.Reduce = "Z", nil, Min
+	result, err = Aggregate(context.Background(), query)
+	assert.Nil(t, err)
+	assert.Equal(t, []messages.ArticleCount{{Name: "Z", Views: 3, Date: start}}, result.Counts)
+	assert.Equal(t, 1, seriesCalls)
+}
+
+// A partial query aggregates the days it can read and returns the rest as missing; with no day readable it still fails
+func Test_Aggregate_Partial(t *testing.T) {
+	start := stubDays(t,
+		[]messages.ArticleCount{{Name: "A", Views: 10}, {Name: "B", Views: 7}},
+		nil,
+		[]messages.ArticleCount{{Name: "A", Views: 30}},
+	)
+	failing := Fetcher
+	Fetcher = func(ctx context.Context, key storage.Key) ([]messages.ArticleCount, error) {
+		if key.Day.Equal(start.AddDate(0, 0, 1)) {
+			return nil, &FetchError{Project: key.Project, Access: key.Access, Date: key.Day, StatusCode: 500, Err: errors.New("500 Internal Server Error")}
+		}
+		return failing(ctx, key)
+	}
+	query := Query{
+		Project: constants.DEFAULT_PROJECT,
+		Access:  constants.DEFAULT_ACCESS,
+		Days:    DaysBetween(start, start.AddDate(0, 0, 3)),
+		Reduce:  Sum,
+		Partial: true,
+	}
+	result, err := Aggregate(context.Background(), query)
+	assert.Nil(t, err)
+	assert.Equal(t, []messages.ArticleCount{{Name: "A", Views: 40}, {Name: "B", Views: 7}}, result.Counts)
+	assert.Equal(t, []time.Time{start.AddDate(0, 0, 1), start.AddDate(0, 0, 3)}, result.Missing)
+
+	//an article whose series can't be read is counted on the days it made the top lists
+	ArticleFetcher = func(ctx context.Context, project string, access string, article string, startdate time.Time, enddate time.Time) ([]messages.ArticleCount, error) {
+		return nil, &FetchError{Project: project, Access: access, Date: startdate, StatusCode: 500, Err: errors.New("500 Internal Server Error")}
+	}
+	defer func() { ArticleFetcher = NewWikipediaFetcher(WikipediaFetcherConfig{}).FetchArticle }()
+	query.Article = "B"
+	result, err = Aggregate(context.Background(), query)
+	assert.Nil(t, err)
+	assert.Equal(t, []messages.ArticleCount{{Name: "B", Views: 7}}, result.Counts)
+	assert.Equal(t, []time.Time{start.AddDate(0, 0, 1), start.AddDate(0, 0, 2), start.AddDate(0, 0, 3)}, result.Missing)
+
+	//strict, the same query fails
+	query.Partial = false
+	_, err = Aggregate(context.Background(), query)
+	assert.NotNil(t, err)
+
+	query.Partial, query.Article, query.Days = true, "", DaysBetween(start.AddDate(0, 0, 3), start.AddDate(0, 0, 4))
+	_, err = Aggregate(context.Background(), query)
+	assert.ErrorIs(t, err, ErrNoData)
+}
+
+// A series query returns the filtered views of each day instead of a ranking, with days lacking data marked missing
+func Test_Aggregate_Series(t *testing.T) {
+	start := stubDays(t,
+		[]messages.ArticleCount{{Name: "Talk:A", Views: 1000}, {Name: "A", Views: 10}, {Name: "B", Views: 7}},
+		[]messages.ArticleCount{{Name: "A", Views: 30}, {Name: "B", Views: 2}},
+	)
+	query := Query{
+		Project: constants.DEFAULT_PROJECT,
+		Access:  constants.DEFAULT_ACCESS,
+		Days:    DaysBetween(start, start.AddDate(0, 0, 2)),
+		Filter:  NameFilter{ExcludeNamespaces: []string{"Talk"}}.DayFilter(),
+		Series:  true,
+	}
+	result, err := Aggregate(context.Background(), query)
+	assert.Nil(t, err)
+	assert.Equal(t, []messages.ArticleCount{
+		{Views: 17, Date: start},
+		{Views: 32, Date: start.AddDate(0, 0, 1)},
+		{Date: start.AddDate(0, 0, 2), Missing: true},
+	}, result.Counts)
+	assert.Empty(t, result.Missing)
+
+	//days without data don't count as missing from the top lists, so need no fallback
+	query.Article = "B"
+	result, err = Aggregate(context.Background(), query)
+	assert.Nil(t, err)
+	assert.Equal(t, []messages.ArticleCount{
+		{Name: "B", Views: 7, Date: start},
+		{Name: "B", Views: 2, Date: start.AddDate(0, 0, 1)},
+		{Name: "B", Date: start.AddDate(0, 0, 2), Missing: true},
+	}, result.Counts)
+}
+
+// Pages of a ranking follow on from each other, whether asked for by offset or by the previous page's cursor
+func Test_Aggregate_Pages(t *testing.T) {
+	start := stubDays(t, []messages.ArticleCount{
+		{Name: "A", Views: 50}, {Name: "B", Views: 40}, {Name: "C", Views: 30}, {Name: "D", Views: 20}, {Name: "E", Views: 10},
+	})
+	query := Query{
+		Project: constants.DEFAULT_PROJECT,
+		Access:  constants.DEFAULT_ACCESS,
+		Days:    DaysBetween(start, start),
+		Reduce:  Sum,
+		Page:    Page{Limit: 2},
+	}
+	names := func(counts []messages.ArticleCount) []string {
+		names := []string{}
+		for _, count := range counts {
+			names = append(names, count.Name)
+		}
+		return names
+	}
+	var pages [][]string
+	for {
+		result, err := Aggregate(context.Background(), query)
+		assert.Nil(t, err)
+		assert.Equal(t, 5, result.Total)
+		pages = append(pages, names(result.Counts))
+		if len(result.Next) == 0 {
+			break
+		}
+		query.Page.Cursor = result.Next
+	}
+	assert.Equal(t, [][]string{{"A", "B"}, {"C", "D"}, {"E"}}, pages)
+
+	query.Page = Page{Offset: 1, Limit: 3}
+	result, err := Aggregate(context.Background(), query)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"B", "C", "D"}, names(result.Counts))
+	assert.NotEmpty(t, result.Next)
+
+	//a limit too large to add to the offset runs to the end
+	query.Page = Page{Offset: 2, Limit: math.MaxInt}
+	result, err = Aggregate(context.Background(), query)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"C", "D", "E"}, names(result.Counts))
+	assert.Empty(t, result.Next)
+
+	//past the end is an empty page, however far past
+	for _, offset := range []int{5, math.MaxInt} {
+		query.Page = Page{Offset: offset, Limit: 3}
+		result, err = Aggregate(context.Background(), query)
+		assert.Nil(t, err)
+		assert.Empty(t, result.Counts, offset)
+		assert.Equal(t, 5, result.Total)
+		assert.Empty(t, result.Next)
+	}
+
+	//a cursor that doesn't match the ranking is refused
+	for _, cursor := range []string{"not base64!", encodeCursor(messages.ArticleCount{Name: "B", Views: 41}), encodeCursor(messages.ArticleCount{Name: "Z", Views: 1})} {
+		query.Page = Page{Limit: 2, Cursor: cursor}
+		_, err = Aggregate(context.Background(), query)
+		assert.ErrorIs(t, err, ErrBadCursor)
+	}
+}
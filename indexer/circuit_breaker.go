@@ -0,0 +1,250 @@
+package indexer
+
+import (
+	"context"
+	"errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"sync"
+	"time"
+)
+
+// Type BreakerState is the state of a CircuitBreaker
+type BreakerState int
+
+const (
+	// BreakerClosed lets every fetch through while tracking the error rate
+	BreakerClosed BreakerState = iota
+	// BreakerHalfOpen lets a limited number of probe fetches through to test whether the upstream has recovered
+	BreakerHalfOpen
+	// BreakerOpen fails every fetch immediately with a CircuitOpenError
+	BreakerOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerHalfOpen:
+		return "half-open"
+	case BreakerOpen:
+		return "open"
+	default:
+		return "unknown"
+	}
+}
+
+// Type CircuitOpenError is returned instead of fetching while the breaker is open. RetryAt is when the breaker will
+// next let a probe through
+type CircuitOpenError struct {
+	RetryAt time.Time
+}
+
+func (e *CircuitOpenError) Error() string {
+	return "Wikipedia is currently failing, not fetching until " + e.RetryAt.UTC().Format(time.RFC3339)
+}
+
+// Type BreakerSettings tunes a CircuitBreaker
+type BreakerSettings struct {
+	// Window is the rolling period over which the error rate is measured
+	Window time.Duration
+	// MinRequests is how many fetches the window must hold before the breaker can open
+	MinRequests int
+	// ErrorRate is the fraction of failed fetches in the window, from 0 to 1, that opens the breaker
+	ErrorRate float64
+	// OpenDuration is how long the breaker stays open before half-opening
+	OpenDuration time.Duration
+	// HalfOpenProbes is how many fetches may be in flight while half-open
+	HalfOpenProbes int
+}
+
+// Type BreakerStatus is a point-in-time view of a CircuitBreaker, for status endpoints
+type BreakerStatus struct {
+	State    string     `json:"state"`
+	Requests int        `json:"requests"`
+	Failures int        `json:"failures"`
+	OpenedAt *time.Time `json:"openedat,omitempty"`
+	RetryAt  *time.Time `json:"retryat,omitempty"`
+}
+
+// number of buckets the rolling window is divided into
+const breakerBuckets = 10
+
+// Type CircuitBreaker stops calls to a failing upstream. While closed it counts outcomes in a rolling window and opens
+// once the error rate passes the threshold; while open every call fails fast; after OpenDuration it half-opens and
+// lets a few probes through, closing again on the first success or reopening on a failure
+type CircuitBreaker struct {
+	settings BreakerSettings
+	mutex    sync.Mutex
+	state    BreakerState
+	openedAt time.Time
+	probes   int
+	// requests and failures are counts per bucket of the rolling window, starting at bucketStart
+	requests    [breakerBuckets]int
+	failures    [breakerBuckets]int
+	bucketStart time.Time
+	now         func() time.Time
+}
+
+var (
+	breakerTransitionsCounter, _ = Meter.Int64Counter(
+		"indexer_circuit_breaker_transitions",
+		metric.WithUnit("1"),
+		metric.WithDescription("number of times the Wikipedia circuit breaker changed state, by new state"),
+	)
+	_, _ = Meter.Int64ObservableGauge(
+		"indexer_circuit_breaker_state",
+		metric.WithUnit("1"),
+		metric.WithDescription("state of the Wikipedia circuit breaker: 0 closed, 1 half-open, 2 open"),
+		metric.WithInt64Callback(func(ctx context.Context, observer metric.Int64Observer) error {
+			observer.Observe(int64(Breaker.State()))
+			return nil
+		}),
+	)
+)
+
+// Function NewCircuitBreaker creates a closed breaker
+func NewCircuitBreaker(settings BreakerSettings) *CircuitBreaker {
+	if settings.HalfOpenProbes < 1 {
+		settings.HalfOpenProbes = 1
+	}
+	return &CircuitBreaker{settings: settings, now: time.Now}
+}
+
+// Allow reports whether a call may go ahead, returning a CircuitOpenError if not. Every allowed call must be followed
+// by exactly one call to Record
+func (b *CircuitBreaker) Allow() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	now := b.now()
+	if b.state == BreakerOpen {
+		retryAt := b.openedAt.Add(b.settings.OpenDuration)
+		if now.Before(retryAt) {
+			return &CircuitOpenError{RetryAt: retryAt}
+		}
+		b.transition(BreakerHalfOpen)
+	}
+	if b.state == BreakerHalfOpen {
+		if b.probes >= b.settings.HalfOpenProbes {
+			return &CircuitOpenError{RetryAt: now.Add(b.settings.OpenDuration)}
+		}
+		b.probes++
+	}
+	return nil
+}
+
+// Record reports the outcome of an allowed call. Errors that say nothing about the upstream's health, such as a
+// day with no data or the caller giving up, should be recorded as successes
+func (b *CircuitBreaker) Record(failed bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	now := b.now()
+	switch b.state {
+	case BreakerHalfOpen:
+		if b.probes > 0 {
+			b.probes--
+		}
+		if failed {
+			b.open(now)
+		} else {
+			b.resetWindow(now)
+			b.transition(BreakerClosed)
+		}
+	case BreakerClosed:
+		bucket := b.advance(now)
+		b.requests[bucket]++
+		if failed {
+			b.failures[bucket]++
+		}
+		requests, failures := b.totals()
+		if requests >= b.settings.MinRequests && float64(failures) >= b.settings.ErrorRate*float64(requests) && failures > 0 {
+			b.open(now)
+		}
+	}
+}
+
+// State returns the breaker's current state, accounting for an open breaker whose OpenDuration has passed
+func (b *CircuitBreaker) State() BreakerState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.state == BreakerOpen && !b.now().Before(b.openedAt.Add(b.settings.OpenDuration)) {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
+
+// Status returns a snapshot of the breaker for reporting
+func (b *CircuitBreaker) Status() BreakerStatus {
+	state := b.State()
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.advance(b.now())
+	requests, failures := b.totals()
+	status := BreakerStatus{State: state.String(), Requests: requests, Failures: failures}
+	if state != BreakerClosed {
+		openedAt, retryAt := b.openedAt, b.openedAt.Add(b.settings.OpenDuration)
+		status.OpenedAt, status.RetryAt = &openedAt, &retryAt
+	}
+	return status
+}
+
+// open must be called with the mutex held
+func (b *CircuitBreaker) open(now time.Time) {
+	b.openedAt = now
+	b.transition(BreakerOpen)
+}
+
+// transition must be called with the mutex held
+func (b *CircuitBreaker) transition(state BreakerState) {
+	if b.state == state {
+		return
+	}
+	b.state = state
+	b.probes = 0
+	breakerTransitionsCounter.Add(context.Background(), 1, metric.WithAttributes(attribute.String("state", state.String())))
+}
+
+// advance rotates out buckets older than the window and returns the index of the bucket for now. Must be called
+// with the mutex held
+func (b *CircuitBreaker) advance(now time.Time) int {
+	width := b.settings.Window / breakerBuckets
+	if width <= 0 {
+		width = time.Nanosecond
+	}
+	elapsed := int(now.Sub(b.bucketStart) / width)
+	if elapsed >= 2*breakerBuckets || elapsed < 0 {
+		b.resetWindow(now)
+		return 0
+	}
+	for ; elapsed >= breakerBuckets; elapsed-- {
+		copy(b.requests[:], b.requests[1:])
+		copy(b.failures[:], b.failures[1:])
+		b.requests[breakerBuckets-1], b.failures[breakerBuckets-1] = 0, 0
+		b.bucketStart = b.bucketStart.Add(width)
+	}
+	return elapsed
+}
+
+// resetWindow must be called with the mutex held
+func (b *CircuitBreaker) resetWindow(now time.Time) {
+	b.requests = [breakerBuckets]int{}
+	b.failures = [breakerBuckets]int{}
+	b.bucketStart = now
+}
+
+// totals must be called with the mutex held
+func (b *CircuitBreaker) totals() (requests int, failures int) {
+	for i := range b.requests {
+		requests += b.requests[i]
+		failures += b.failures[i]
+	}
+	return requests, failures
+}
+
+// isUpstreamFailure decides whether a fetch error counts against the breaker
+func isUpstreamFailure(err error) bool {
+	return err != nil &&
+		!errors.Is(err, ErrNoData) &&
+		!errors.Is(err, context.Canceled) &&
+		!errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,104 @@
+package indexer
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"pelotechfun/constants"
+	"pelotechfun/messages"
+	"pelotechfun/storage"
+	"testing"
+	"time"
+)
+
+// Walk the breaker through closed -> open -> half-open -> open -> half-open -> closed
+func Test_CircuitBreaker_Transitions(t *testing.T) {
+	now := time.Now()
+	breaker := NewCircuitBreaker(BreakerSettings{
+		Window:       10 * time.Second,
+		MinRequests:  4,
+		ErrorRate:    0.4,
+		OpenDuration: 5 * time.Second,
+	})
+	breaker.now = func() time.Time { return now }
+
+	//one failure in four stays closed, a second one makes two in five and trips it
+	for _, failed := range []bool{true, false, false, false} {
+		assert.Nil(t, breaker.Allow())
+		breaker.Record(failed)
+	}
+	assert.Equal(t, BreakerClosed, breaker.State())
+	assert.Nil(t, breaker.Allow())
+	breaker.Record(true)
+	assert.Equal(t, BreakerOpen, breaker.State())
+
+	var openErr *CircuitOpenError
+	assert.ErrorAs(t, breaker.Allow(), &openErr)
+	assert.Equal(t, now.Add(5*time.Second), openErr.RetryAt)
+
+	//after the open duration a single probe is let through; its failure reopens the breaker
+	now = now.Add(5 * time.Second)
+	assert.Equal(t, BreakerHalfOpen, breaker.State())
+	assert.Nil(t, breaker.Allow())
+	assert.ErrorAs(t, breaker.Allow(), &openErr)
+	breaker.Record(true)
+	assert.Equal(t, BreakerOpen, breaker.State())
+
+	//a successful probe closes it with a clean window
+	now = now.Add(5 * time.Second)
+	assert.Nil(t, breaker.Allow())
+	breaker.Record(false)
+	assert.Equal(t, BreakerClosed, breaker.State())
+	status := breaker.Status()
+	assert.Equal(t, "closed", status.State)
+	assert.Equal(t, 0, status.Requests)
+	assert.Nil(t, status.OpenedAt)
+}
+
+// Failures older than the window are forgotten
+func Test_CircuitBreaker_Window(t *testing.T) {
+	now := time.Now()
+	breaker := NewCircuitBreaker(BreakerSettings{Window: 10 * time.Second, MinRequests: 2, ErrorRate: 0.5, OpenDuration: time.Second})
+	breaker.now = func() time.Time { return now }
+	assert.Nil(t, breaker.Allow())
+	breaker.Record(true)
+	now = now.Add(15 * time.Second)
+	assert.Nil(t, breaker.Allow())
+	breaker.Record(false)
+	assert.Equal(t, BreakerClosed, breaker.State())
+	assert.Equal(t, 1, breaker.Status().Requests)
+}
+
+// Once Wikipedia keeps failing, queries stop calling the fetcher and report a CircuitOpenError. Days with no data
+// don't count as failures
+func Test_GetArticleCountsForDateRange_CircuitOpen(t *testing.T) {
+	Breaker = NewCircuitBreaker(BreakerSettings{Window: time.Minute, MinRequests: 5, ErrorRate: 0.5, OpenDuration: time.Minute})
+	defer func() { Breaker = NewCircuitBreaker(DefaultBreakerSettings) }()
+	DB = storage.Adapt(storage.NewLocalMapStorage())
+	start, _ := time.Parse(constants.DATELAYOUT, "20210101")
+	end, _ := time.Parse(constants.DATELAYOUT, "20210110")
+
+	Fetcher = func(ctx context.Context, key storage.Key) ([]messages.ArticleCount, error) {
+		return nil, &FetchError{Date: key.Day, StatusCode: 404, Err: ErrNoData}
+	}
+	_, err := GetArticleCountsForDateRange(context.Background(), constants.DEFAULT_PROJECT, constants.DEFAULT_ACCESS, start, end, false, Page{}, NameFilter{})
+	assert.ErrorIs(t, err, ErrNoData)
+	assert.Equal(t, BreakerClosed, Breaker.State())
+
+	Fetcher = func(ctx context.Context, key storage.Key) ([]messages.ArticleCount, error) {
+		return nil, &FetchError{Date: key.Day, StatusCode: 503, Err: errors.New("503 Service Unavailable")}
+	}
+	_, err = GetArticleCountsForDateRange(context.Background(), constants.DEFAULT_PROJECT, constants.DEFAULT_ACCESS, start, end, false, Page{}, NameFilter{})
+	assert.NotNil(t, err)
+	assert.Equal(t, BreakerOpen, Breaker.State())
+
+	calls := 0
+	Fetcher = func(ctx context.Context, key storage.Key) ([]messages.ArticleCount, error) {
+		calls++
+		return []messages.ArticleCount{}, nil
+	}
+	_, err = GetArticleCountsForDateRange(context.Background(), constants.DEFAULT_PROJECT, constants.DEFAULT_ACCESS, start, end, false, Page{}, NameFilter{})
+	var openErr *CircuitOpenError
+	assert.ErrorAs(t, err, &openErr)
+	assert.Equal(t, 0, calls)
+}
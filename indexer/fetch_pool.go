@@ -0,0 +1,65 @@
+package indexer
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/metric"
+	"time"
+)
+
+var (
+	fetchQueueDepth, _ = Meter.Int64UpDownCounter(
+		"indexer_fetch_queue_depth",
+		metric.WithUnit("1"),
+		metric.WithDescription("number of requests to Wikipedia waiting for a free fetch slot"),
+	)
+	fetchWaitTime, _ = Meter.Float64Histogram(
+		"indexer_fetch_wait_time",
+		metric.WithUnit("s"),
+		metric.WithDescription("time requests to Wikipedia spent waiting for a free fetch slot"),
+	)
+)
+
+// fetchPool is a counting semaphore that caps how many HTTP requests to Wikipedia run at once across every query, so a
+// burst of wide queries queues up instead of firing hundreds of simultaneous calls. Slots are held per attempt, not
+// across retry backoff
+type fetchPool struct {
+	slots chan struct{}
+}
+
+func newFetchPool(size int) *fetchPool {
+	if size < 1 {
+		size = 1
+	}
+	return &fetchPool{slots: make(chan struct{}, size)}
+}
+
+// acquire blocks until a slot is free or ctx is done. Every successful acquire must be paired with a release
+func (p *fetchPool) acquire(ctx context.Context) error {
+	select {
+	case p.slots <- struct{}{}:
+		fetchWaitTime.Record(ctx, 0)
+		return nil
+	default:
+	}
+	start := time.Now()
+	fetchQueueDepth.Add(ctx, 1)
+	defer fetchQueueDepth.Add(ctx, -1)
+	select {
+	case p.slots <- struct{}{}:
+		fetchWaitTime.Record(ctx, time.Since(start).Seconds())
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *fetchPool) release() {
+	<-p.slots
+}
+
+// Function SetFetchConcurrency sets the maximum number of simultaneous HTTP requests to Wikipedia shared by all
+// queries. It is meant to be called once at startup; requests already holding a slot of the previous pool are not
+// affected
+func SetFetchConcurrency(n int) {
+	dayFetchPool = newFetchPool(n)
+}
@@ -0,0 +1,121 @@
+package indexer
+
+import (
+	"pelotechfun/messages"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// MAIN_PAGE is English Wikipedia's main page, the most viewed page of nearly every day's top list
+const MAIN_PAGE = "Main_Page"
+
+// NON_ARTICLE_NAMESPACES are the canonical names of the namespaces that don't hold articles, as prefixes of page names
+// before the colon. Talk is the articles' own talk namespace; the others' (e.g. User_talk) are matched through them.
+// Every project understands them, though most list their pages under localized names
+var NON_ARTICLE_NAMESPACES = []string{
+	"Special", "Media", "Talk", "User", "Wikipedia", "File", "MediaWiki", "Template", "Help", "Category", "Portal",
+	"Draft", "TimedText", "Module",
+}
+
+// Type projectPages is how a project names the pages that aren't encyclopedia articles
+type projectPages struct {
+	mainPage string
+	// namespaces are the localized names of NON_ARTICLE_NAMESPACES and of their talk namespaces, plus any namespaces
+	// of the project's own
+	namespaces []string
+}
+
+// articleProjects are the projects ArticlesOnly knows the main page and namespace names of
+var articleProjects = map[string]projectPages{
+	"en.wikipedia": {mainPage: MAIN_PAGE},
+	"de.wikipedia": {mainPage: "Wikipedia:Hauptseite", namespaces: []string{
+		"Medium", "Spezial", "Diskussion", "Benutzer", "Benutzerin", "Benutzer_Diskussion", "Benutzerin_Diskussion",
+		"Wikipedia_Diskussion", "Datei", "Datei_Diskussion", "MediaWiki_Diskussion", "Vorlage", "Vorlage_Diskussion",
+		"Hilfe", "Hilfe_Diskussion", "Kategorie", "Kategorie_Diskussion", "Portal_Diskussion", "Modul",
+		"Modul_Diskussion",
+	}},
+	"fr.wikipedia": {mainPage: "Wikipédia:Accueil_principal", namespaces: []string{
+		"Média", "Spécial", "Discussion", "Utilisateur", "Utilisatrice", "Discussion_utilisateur",
+		"Discussion_utilisatrice", "Wikipédia", "Discussion_Wikipédia", "Fichier", "Discussion_fichier",
+		"Discussion_MediaWiki", "Modèle", "Discussion_modèle", "Aide", "Discussion_aide", "Catégorie",
+		"Discussion_catégorie", "Portail", "Discussion_Portail", "Projet", "Discussion_Projet", "Référence",
+		"Discussion_Référence", "Discussion_module",
+	}},
+	"es.wikipedia": {mainPage: "Wikipedia:Portada", namespaces: []string{
+		"Medio", "Especial", "Discusión", "Usuario", "Usuaria", "Usuario_discusión", "Usuaria_discusión",
+		"Wikipedia_discusión", "Archivo", "Archivo_discusión", "MediaWiki_discusión", "Plantilla",
+		"Plantilla_discusión", "Ayuda", "Ayuda_discusión", "Categoría", "Categoría_discusión", "Portal_discusión",
+		"Wikiproyecto", "Wikiproyecto_discusión", "Módulo", "Módulo_discusión",
+	}},
+}
+
+// Type NameFilter picks which articles a ranking keeps by their names
+type NameFilter struct {
+	// ExcludeNamespaces drops articles in these namespaces or their talk namespaces, given by name without the colon
+	ExcludeNamespaces []string
+	// ExcludePage, when set, drops the article of that name, e.g. a main page
+	ExcludePage string
+	// Include, when not empty, keeps only articles with names matching at least one of its patterns
+	Include []*regexp.Regexp
+	// Exclude drops articles with names matching any of its patterns
+	Exclude []*regexp.Regexp
+}
+
+// Function ArticlesOnly makes a filter keeping only the encyclopedia articles of project, dropping its main page and
+// every other namespace. ok is false for projects outside articleProjects, whose names it can't tell apart
+func ArticlesOnly(project string) (filter NameFilter, ok bool) {
+	pages, ok := articleProjects[project]
+	if !ok {
+		return NameFilter{}, false
+	}
+	return NameFilter{
+		ExcludeNamespaces: append(slices.Clone(NON_ARTICLE_NAMESPACES), pages.namespaces...),
+		ExcludePage:       pages.mainPage,
+	}, true
+}
+
+// Function PrefixPattern matches names starting with prefix, for NameFilter.Include and Exclude
+func PrefixPattern(prefix string) *regexp.Regexp {
+	return regexp.MustCompile("^" + regexp.QuoteMeta(prefix))
+}
+
+// Function Keep reports whether f keeps the article called name
+func (f NameFilter) Keep(name string) bool {
+	if len(f.ExcludePage) > 0 && name == f.ExcludePage {
+		return false
+	}
+	if namespace, _, ok := strings.Cut(name, ":"); ok {
+		subject := strings.TrimSuffix(namespace, "_talk")
+		for _, excluded := range f.ExcludeNamespaces {
+			if strings.EqualFold(namespace, excluded) || strings.EqualFold(subject, excluded) {
+				return false
+			}
+		}
+	}
+	for _, pattern := range f.Exclude {
+		if pattern.MatchString(name) {
+			return false
+		}
+	}
+	if len(f.Include) == 0 {
+		return true
+	}
+	for _, pattern := range f.Include {
+		if pattern.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Function DayFilter turns f into a Query filter, or nil if f keeps every article
+func (f NameFilter) DayFilter() DayFilter {
+	if len(f.ExcludeNamespaces) == 0 && len(f.ExcludePage) == 0 && len(f.Include) == 0 && len(f.Exclude) == 0 {
+		return nil
+	}
+	return func(day time.Time, count messages.ArticleCount) bool {
+		return f.Keep(count.Name)
+	}
+}
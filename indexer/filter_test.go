@@ -0,0 +1,84 @@
+package indexer
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"pelotechfun/constants"
+	"pelotechfun/messages"
+	"regexp"
+	"testing"
+)
+
+func Test_NameFilter_Keep(t *testing.T) {
+	english, _ := ArticlesOnly("en.wikipedia")
+	german, _ := ArticlesOnly("de.wikipedia")
+	tests := []struct {
+		name   string
+		filter NameFilter
+		kept   []string
+		gone   []string
+	}{
+		{name: "zero value keeps everything", filter: NameFilter{},
+			kept: []string{"Main_Page", "Special:Search", "Dua_Lipa"}},
+		{name: "articles only", filter: english,
+			kept: []string{"Dua_Lipa", "Star_Wars:_The_Last_Jedi", "Main_Page_(disambiguation)"},
+			gone: []string{"Main_Page", "Special:Search", "File:Example.jpg", "Wikipedia:About", "User_talk:Jimbo_Wales", "Talk:Dua_Lipa", "special:Random"}},
+		{name: "articles only, in German", filter: german,
+			kept: []string{"Dua_Lipa", "Main_Page", "Spezialeffekt", "Star_Wars:_Die_letzten_Jedi"},
+			gone: []string{"Wikipedia:Hauptseite", "Spezial:Suche", "Datei:Beispiel.jpg", "Benutzer_Diskussion:Jimbo_Wales", "Diskussion:Dua_Lipa", "Special:Search"}},
+		{name: "exclusions win over inclusions", filter: NameFilter{
+			Include: []*regexp.Regexp{PrefixPattern("Deaths_in_"), regexp.MustCompile(`_\(film\)$`)},
+			Exclude: []*regexp.Regexp{regexp.MustCompile(`^Deaths_in_19`)},
+		},
+			kept: []string{"Deaths_in_2021", "Dune_(film)"},
+			gone: []string{"Deaths_in_1999", "Dua_Lipa"}},
+		{name: "prefixes are literal", filter: NameFilter{Exclude: []*regexp.Regexp{PrefixPattern("C++")}},
+			kept: []string{"CCC"},
+			gone: []string{"C++", "C++_classes"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, name := range test.kept {
+				assert.True(t, test.filter.Keep(name), name)
+			}
+			for _, name := range test.gone {
+				assert.False(t, test.filter.Keep(name), name)
+			}
+		})
+	}
+}
+
+// Only projects whose namespace names are known have an articles only filter
+func Test_ArticlesOnly_Projects(t *testing.T) {
+	for _, project := range []string{"en.wikipedia", "de.wikipedia", "fr.wikipedia", "es.wikipedia"} {
+		filter, ok := ArticlesOnly(project)
+		assert.True(t, ok, project)
+		assert.NotEmpty(t, filter.ExcludePage, project)
+	}
+	french, _ := ArticlesOnly("fr.wikipedia")
+	assert.False(t, french.Keep("Wikipédia:Accueil_principal"))
+	assert.False(t, french.Keep("Discussion_utilisateur:Jimbo_Wales"))
+	assert.True(t, french.Keep("Discussion_(musique)"))
+	_, ok := ArticlesOnly("ja.wikipedia")
+	assert.False(t, ok)
+
+	//each filter has its own namespaces to append to
+	filter, _ := ArticlesOnly("en.wikipedia")
+	filter.ExcludeNamespaces = append(filter.ExcludeNamespaces, "Dua")
+	assert.NotContains(t, NON_ARTICLE_NAMESPACES, "Dua")
+	english, _ := ArticlesOnly("en.wikipedia")
+	assert.True(t, english.Keep("Dua:Lipa"))
+}
+
+// Articles are filtered before they are ranked, so pages and totals only count the ones kept
+func Test_GetArticleCountsForDateRange_Filtered(t *testing.T) {
+	start := stubDays(t, []messages.ArticleCount{
+		{Name: "Main_Page", Views: 500}, {Name: "Special:Search", Views: 400}, {Name: "A", Views: 30}, {Name: "B", Views: 20}, {Name: "C", Views: 10},
+	})
+	filter, _ := ArticlesOnly(constants.DEFAULT_PROJECT)
+	result, err := GetArticleCountsForDateRange(context.Background(), constants.DEFAULT_PROJECT, constants.DEFAULT_ACCESS, start, start, false, Page{Limit: 2}, filter)
+	assert.Nil(t, err)
+	assert.Equal(t, []messages.ArticleCount{{Name: "A", Views: 30}, {Name: "B", Views: 20}}, result.ArticleCounts)
+	assert.Equal(t, 3, result.Total)
+	assert.NotEmpty(t, result.Next)
+}
@@ -1,247 +1,279 @@
 // Package indexer contains functions for sourcing and aggregating article counts. It makes heavy use of the
 // github.com/zavitax/sortedset-go implementation for ranking.  It depends on a Storage implementation for caching
-// and a fetcher function for retrieving the articles from the original source
-// TODO: these api calls have a mostly similar algorithm that could be refactored into a higher-order function
+// and a fetcher function for retrieving the articles from the original source. The range queries are declared as a
+// Query and run by Aggregate
 package indexer
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
-	"github.com/zavitax/sortedset-go"
-	"io"
-	"net/http"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric"
 	"pelotechfun/constants"
 	"pelotechfun/messages"
 	"pelotechfun/storage"
-	"strconv"
 	"sync"
 	"time"
 )
 
-// Type fetcher is an internal type that describes a standard function for fetching day counts from an external source
-type fetcher = func(date time.Time) ([]messages.ArticleCount, error)
+// Type fetcher is an internal type that describes a standard function for fetching the day counts of a wiki project
+// (e.g. "en.wikipedia") and access method (e.g. "mobile-web") from an external source. It should give up once ctx is
+// done
+type fetcher = func(ctx context.Context, key storage.Key) ([]messages.ArticleCount, error)
+
+// Type articleFetcher is an internal type that describes a standard function for fetching one article's daily views
+// from startdate to enddate inclusive, one count per day with Date set. It should give up once ctx is done
+type articleFetcher = func(ctx context.Context, project string, access string, article string, startdate time.Time, enddate time.Time) ([]messages.ArticleCount, error)
+
+// ErrTimeout is wrapped, along with context.DeadlineExceeded, by the errors of queries whose context's deadline passed
+// before every day could be read
+var ErrTimeout = errors.New("query timed out")
 
 var (
 	//Var Fetcher holds an instance of a fetcher function. It is exported to enable  stubbing for tests
-	Fetcher fetcher = wikipediafetcher
+	Fetcher fetcher = NewWikipediaFetcher(WikipediaFetcherConfig{}).Fetch
+	//Var BreakdownAccessMethods are the access methods GetAccessBreakdown reports on, which between them make up all-access
+	BreakdownAccessMethods = []string{constants.ACCESS_DESKTOP, constants.ACCESS_MOBILE_APP, constants.ACCESS_MOBILE_WEB}
+	//Var ArticleFetcher holds an instance of an articleFetcher function, used for articles missing from the top lists.
+	//It is exported to enable stubbing for tests
+	ArticleFetcher articleFetcher = NewWikipediaFetcher(WikipediaFetcherConfig{}).FetchArticle
 	//Var DB is a cache for article day counts.  It is exported to enable stubbing for tests
-	DB storage.Storage = storage.NewLocalMapStorage()
-)
+	DB storage.ContextStorage = storage.Adapt(storage.NewLocalMapStorage())
 
-// wikipediafetcher is a wrapper fetcher function for the Wikipedia Pageviews API.
-func wikipediafetcher(date time.Time) ([]messages.ArticleCount, error) {
-	counts := []messages.ArticleCount{}
-	year := strconv.Itoa(date.Year())
-	month := date.Format(constants.TWODAYMONTH)
-	day := date.Format(constants.TWODAYDAYOFWEEK)
-	url := fmt.Sprintf(constants.PAGEVIEWS_URL, year, month, day)
-
-	//Call the API and return an error if any
-	resp, err := http.Get(url)
-	if err != nil || resp.StatusCode != http.StatusOK {
-		message := "Unable to retrieve page count data from Wikipedia: " + date.Format(constants.DATELAYOUT)
-		log.Error(message)
-		return counts, errors.New(message)
-	}
-	//Map body into struct representation, return an error if it fails
-	defer resp.Body.Close()
-	body, _ := io.ReadAll(resp.Body)
-	responseStruct := messages.WPPageViewsPayload{}
-	err2 := json.Unmarshal(body, &responseStruct)
-	if err2 != nil {
-		return []messages.ArticleCount{}, err2
+	Meter = otel.Meter(constants.METER_NAME)
+	//dayFetches shares a single Fetcher call between every goroutine that misses the cache for the same day
+	dayFetches                 = newFlightGroup()
+	coalescedFetchesCounter, _ = Meter.Int64Counter(
+		"indexer_coalesced_fetches",
+		metric.WithUnit("1"),
+		metric.WithDescription("number of day fetches that waited on an identical fetch already in flight instead of calling the fetcher"),
+	)
+	//dayFetchPool caps the number of requests to Wikipedia in progress at once across all queries
+	dayFetchPool = newFetchPool(constants.DEFAULT_FETCH_CONCURRENCY)
+	//fetchRateLimiter keeps requests to Wikipedia across all queries, retries included, under Wikimedia's rate limits
+	fetchRateLimiter = newTokenBucket(constants.DEFAULT_FETCH_RATE, constants.DEFAULT_FETCH_BURST)
+	//Var Breaker stops fetches while Wikipedia is failing. It is exported so it can be tuned at startup and reported on
+	Breaker = NewCircuitBreaker(DefaultBreakerSettings)
+	//Var DefaultBreakerSettings opens the breaker when half of at least 20 fetches in 30 seconds fail
+	DefaultBreakerSettings = BreakerSettings{
+		Window:         30 * time.Second,
+		MinRequests:    20,
+		ErrorRate:      0.5,
+		OpenDuration:   30 * time.Second,
+		HalfOpenProbes: 1,
 	}
+)
 
-	//Finally map into our internal entity representation
-	articles := responseStruct.Items[0].Articles
-	for _, article := range articles {
-		counts = append(counts, messages.ArticleCount{
-			Name:  article.Article,
-			Views: article.Views,
-		})
-	}
-	return counts, nil
+// Function GetArticleCountsForDateRange concurrently fetches and assembles a view ranking of all articles of a wiki
+// project in a date range, counting views through the given access method. When partial, days that can't be read are
+// left out and listed as missing instead of failing the call. Articles filter doesn't keep are dropped before ranking,
+// then only page of the ranking is returned, along with the total number of articles ranked and the cursor of the
+// next page
+func GetArticleCountsForDateRange(ctx context.Context, project string, access string, startdate time.Time, enddate time.Time, partial bool, page Page, filter NameFilter) (messages.ArticleCountsForDateRange, error) {
+	return aggregateForDateRange(ctx, Query{
+		Project: project,
+		Access:  access,
+		Days:    DaysBetween(startdate, enddate),
+		Filter:  filter.DayFilter(),
+		Reduce:  Sum,
+		Partial: partial,
+		Page:    page,
+	}, startdate, enddate)
 }
 
-// Function GetArticleCountsForDateRange concurrently fetches and assembles a view ranking of all articles in a date range
-func GetArticleCountsForDateRange(startdate time.Time, enddate time.Time) (messages.ArticleCountsForDateRange, error) {
-	wg := sync.WaitGroup{}
-	index := sortedset.New[string, int, messages.ArticleCount]()
-	ssUpdateMutex := sync.Mutex{}
-	errorChannel := make(chan error, constants.MAXDAYINTERVAL)
-	for d := startdate; !d.After(enddate) == true; d = d.AddDate(0, 0, 1) {
-		wg.Add(1)
-		go func(date time.Time) {
-			defer wg.Done()
-			countsForDay, err := getArticleCountsForDay(date)
-			if err != nil {
-				errorChannel <- err
-				return
-			}
-			for _, countobject := range countsForDay {
-				ssUpdateMutex.Lock()
-				node := index.GetByKey(countobject.Name)
-				if node == nil {
-					index.AddOrUpdate(countobject.Name, countobject.Views, countobject)
-				} else {
-					aggregateCountObj := node.Value
-					aggregateCountObj.Views = aggregateCountObj.Views + countobject.Views
-					index.AddOrUpdate(countobject.Name, aggregateCountObj.Views, aggregateCountObj)
-				}
-				ssUpdateMutex.Unlock()
-			}
-		}(d)
-	}
+// Function GetCountsForArticleInRange assembles a total view count for a specific article of a wiki project in a date
+// range, counting views through the given access method. partial is as for GetArticleCountsForDateRange
+func GetCountsForArticleInRange(ctx context.Context, project string, access string, article string, startdate time.Time, enddate time.Time, partial bool) (messages.ArticleCountsForDateRange, error) {
+	return aggregateForDateRange(ctx, Query{
+		Project: project,
+		Access:  access,
+		Days:    DaysBetween(startdate, enddate),
+		Reduce:  Sum,
+		Article: article,
+		Partial: partial,
+	}, startdate, enddate)
+}
 
-	wg.Wait()
-	//Errors in any of the child calls will abort the overall call since we won't have correct counts.  Assemble the message and pass up the error
-	message := ""
-	close(errorChannel)
-	for err := range errorChannel {
-		message = message + err.Error() + "\n"
-	}
-	if len(message) > 0 {
-		return messages.ArticleCountsForDateRange{}, errors.New(message)
+// Function GetTopDayForArticle returns the most viewed day for an article of a wiki project in the time range,
+// counting views through the given access method. enddate is exclusive. Articles missing from the daily top lists on
+// any day are ranked from their per-article series instead. partial is as for GetArticleCountsForDateRange
+func GetTopDayForArticle(ctx context.Context, project string, access string, article string, startdate time.Time, enddate time.Time, partial bool) (messages.ArticleCountsForDateRange, error) {
+	return aggregateForDateRange(ctx, Query{
+		Project: project,
+		Access:  access,
+		Days:    DaysBetween(startdate, enddate.AddDate(0, 0, -1)),
+		Reduce:  Max,
+		Article: article,
+		Partial: partial,
+	}, startdate, enddate)
+}
+
+// Function aggregateForDateRange runs q and wraps its results for the date range asked for, flagged incomplete if
+// any days are missing from them. Rankings of every article also carry their total and next page cursor
+func aggregateForDateRange(ctx context.Context, q Query, startdate time.Time, enddate time.Time) (messages.ArticleCountsForDateRange, error) {
+	result, err := Aggregate(ctx, q)
+	if err != nil {
+		return messages.ArticleCountsForDateRange{}, err
 	}
-	allTheRankedNodes := index.GetRangeByRank(-1, 1, false)
 	payload := messages.ArticleCountsForDateRange{}
 	payload.StartDate = startdate
 	payload.EndDate = enddate
-	for _, node := range allTheRankedNodes {
-		payload.ArticleCounts = append(payload.ArticleCounts, node.Value)
+	payload.ArticleCounts = result.Counts
+	if len(q.Article) == 0 {
+		payload.Total = result.Total
+		payload.Next = result.Next
 	}
-
+	payload.Incomplete = len(result.Missing) > 0
+	payload.MissingDays = result.Missing
 	return payload, nil
 }
 
-// Function GetCountsForArticleInRange assembles a total view count for q specific article in a date range
-func GetCountsForArticleInRange(article string, startdate time.Time, enddate time.Time) (messages.ArticleCountsForDateRange, error) {
+// Function GetTimeSeriesForArticle returns an article's views for every day from startdate to enddate inclusive, in
+// date order with Date set. It is an Aggregate Series query, so days come from the cached top lists, or from the
+// article's own series if it is missing from any of them, and are zero where that has no views either. Days Wikipedia
+// has no data for at all are marked Missing rather than failing the call. When partial, so are days that fail to be
+// read, which are also listed in MissingDays
+func GetTimeSeriesForArticle(ctx context.Context, project string, access string, article string, startdate time.Time, enddate time.Time, partial bool) (messages.ArticleCountsForDateRange, error) {
+	return aggregateForDateRange(ctx, Query{
+		Project: project,
+		Access:  access,
+		Days:    DaysBetween(startdate, enddate),
+		Article: article,
+		Partial: partial,
+		Series:  true,
+	}, startdate, enddate)
+}
+
+// Function GetAccessBreakdown runs query once for each of BreakdownAccessMethods concurrently and returns the results
+// side by side, keyed by access method. It fails if any of the queries do. The breakdown is incomplete if any of the
+// results are, missing the days any of them miss
+func GetAccessBreakdown(ctx context.Context, query func(ctx context.Context, access string) (messages.ArticleCountsForDateRange, error)) (messages.ArticleCountsByAccess, error) {
+	results := make([]messages.ArticleCountsForDateRange, len(BreakdownAccessMethods))
+	errs := make([]error, len(BreakdownAccessMethods))
 	wg := sync.WaitGroup{}
-	index := sortedset.New[string, int, messages.ArticleCount]()
-	ssUpdateMutex := sync.Mutex{}
-	errorChannel := make(chan error, constants.MAXDAYINTERVAL)
-	for d := startdate; !d.After(enddate) == true; d = d.AddDate(0, 0, 1) {
+	for i, access := range BreakdownAccessMethods {
 		wg.Add(1)
-		go func(date time.Time) {
+		go func(i int, access string) {
 			defer wg.Done()
-			countsForDay, err := getArticleCountsForDay(date)
-			if err != nil {
-				log.Debugf("Unable to retrieve data for date: %v", date)
-				errorChannel <- err
-				return
-			}
-			for _, countobject := range countsForDay {
-				if countobject.Name == article {
-					ssUpdateMutex.Lock()
-					node := index.GetByKey(countobject.Name)
-					if node == nil {
-						index.AddOrUpdate(countobject.Name, countobject.Views, countobject)
-					} else {
-						aggregateCountObj := node.Value
-						aggregateCountObj.Views = aggregateCountObj.Views + countobject.Views
-						index.AddOrUpdate(countobject.Name, aggregateCountObj.Views, aggregateCountObj)
-					}
-					ssUpdateMutex.Unlock()
-				}
-
-			}
-		}(d)
+			results[i], errs[i] = query(ctx, access)
+		}(i, access)
 	}
-
 	wg.Wait()
-	//Errors in any of the child calls will abort the overall call since we won't have correct counts.  Assemble the message and pass up the error
-	message := ""
-	close(errorChannel)
-	for err := range errorChannel {
-		message = message + err.Error() + "\n"
+	if err := errors.Join(errs...); err != nil {
+		return messages.ArticleCountsByAccess{}, queryError(ctx, err)
 	}
-	if len(message) > 0 {
-		return messages.ArticleCountsForDateRange{}, errors.New(message)
+	payload := messages.ArticleCountsByAccess{
+		StartDate: results[0].StartDate,
+		EndDate:   results[0].EndDate,
+		Access:    make(map[string][]messages.ArticleCount, len(results)),
 	}
-	allTheRankedNodes := index.GetRangeByRank(-1, 1, false)
-	payload := messages.ArticleCountsForDateRange{}
-	payload.StartDate = startdate
-	payload.EndDate = enddate
-	for _, node := range allTheRankedNodes {
-		payload.ArticleCounts = append(payload.ArticleCounts, node.Value)
+	for i, access := range BreakdownAccessMethods {
+		payload.Access[access] = results[i].ArticleCounts
+		if results[i].Total > 0 {
+			if payload.Totals == nil {
+				payload.Totals = make(map[string]int, len(results))
+			}
+			payload.Totals[access] = results[i].Total
+		}
+		payload.MissingDays = mergeDays(payload.MissingDays, results[i].MissingDays)
 	}
-
+	payload.Incomplete = len(payload.MissingDays) > 0
 	return payload, nil
 }
 
-// Function GetTopDayForArticle returns the most viewed day for an article in the time range
-func GetTopDayForArticle(article string, startdate time.Time, enddate time.Time) (messages.ArticleCountsForDateRange, error) {
-	wg := sync.WaitGroup{}
-	index := sortedset.New[string, int, messages.ArticleCount]()
-	ssUpdateMutex := sync.Mutex{}
-	errorChannel := make(chan error, constants.MAXDAYINTERVAL)
-	for d := startdate; d.Before(enddate) == true; d = d.AddDate(0, 0, 1) {
-		wg.Add(1)
-		go func(date time.Time) {
-			defer wg.Done()
-			countsForDay, err := getArticleCountsForDay(date)
-			if err != nil {
-				log.Debugf("Unable to retrieve data for date: %v", date)
-				errorChannel <- err
-				return
-			}
-			for _, countobject := range countsForDay {
-				if countobject.Name == article {
-					log.Debugf("count object date: %s  views: %d", date.String(), countobject.Views)
-					ssUpdateMutex.Lock()
-					node := index.GetByKey(countobject.Name)
-					if node == nil {
-						countobject.Date = date
-						index.AddOrUpdate(countobject.Name, countobject.Views, countobject)
-					} else {
-						aggregateCountObj := node.Value
-						if countobject.Views > aggregateCountObj.Views {
-							countobject.Date = date
-							index.AddOrUpdate(countobject.Name, countobject.Views, countobject)
-						}
-					}
-					ssUpdateMutex.Unlock()
-				}
-
-			}
-		}(d)
+// Function getArticleCountsForDay will check the db cache for the slice of article counts and if not found will
+// pull from the Wikipedia api through guardedFetch. Concurrent misses for the same day share one fetch. Storage
+// failures are logged and treated as a cache miss, except for a done context which aborts the lookup
+func getArticleCountsForDay(ctx context.Context, key storage.Key) ([]messages.ArticleCount, error) {
+	cachedcounts, ok, err := getCachedCountsForDay(ctx, key)
+	if err != nil || ok {
+		return cachedcounts, err
+	}
+	counts, err, shared := dayFetches.Do(ctx, key.String(), func(ctx context.Context) ([]messages.ArticleCount, error) {
+		//a flight for this day may have completed between our cache miss and joining the group
+		cachedcounts, ok, err := getCachedCountsForDay(ctx, key)
+		if err != nil || ok {
+			return cachedcounts, err
+		}
+		fetchedCounts, err := guardedFetch(ctx, func() ([]messages.ArticleCount, error) {
+			return Fetcher(ctx, key)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err = DB.Put(ctx, key, fetchedCounts); err != nil {
+			log.Warnf("Unable to cache %s in storage: %v", key, err)
+		}
+		return fetchedCounts, nil
+	})
+	if shared {
+		coalescedFetchesCounter.Add(ctx, 1)
 	}
+	return counts, err
+}
 
-	wg.Wait()
+// Function getArticleSeries fetches an article's daily views from startdate to enddate inclusive through
+// ArticleFetcher. A range the API has no data for is an empty series rather than an error
+func getArticleSeries(ctx context.Context, project string, access string, article string, startdate time.Time, enddate time.Time) ([]messages.ArticleCount, error) {
+	series, err := guardedFetch(ctx, func() ([]messages.ArticleCount, error) {
+		return ArticleFetcher(ctx, project, access, article, startdate, enddate)
+	})
+	if errors.Is(err, ErrNoData) {
+		return []messages.ArticleCount{}, nil
+	}
+	return series, err
+}
 
-	//Errors in any of the child calls will abort the overall call since we won't have correct counts.  Assemble the message and pass up the error
-	message := ""
-	close(errorChannel)
-	for err := range errorChannel {
-		message = message + err.Error() + "\n"
+// Function guardedFetch makes an outbound call to Wikipedia unless the circuit breaker is open, in which case it fails
+// fast, and records the outcome with the breaker
+func guardedFetch(ctx context.Context, fetch func() ([]messages.ArticleCount, error)) ([]messages.ArticleCount, error) {
+	breaker := Breaker
+	if err := breaker.Allow(); err != nil {
+		return nil, err
 	}
-	if len(message) > 0 {
-		return messages.ArticleCountsForDateRange{}, errors.New(message)
+	counts, err := fetch()
+	breaker.Record(isUpstreamFailure(err))
+	return counts, err
+}
+
+// Function throttle waits for a free slot in the shared fetch pool and then for the shared rate limiter before each
+// HTTP request to Wikipedia, retries included. The returned release frees the slot once the request is done, so
+// backoff between retries holds neither a slot nor a token
+func throttle(ctx context.Context) (release func(), err error) {
+	pool := dayFetchPool
+	if err := pool.acquire(ctx); err != nil {
+		return nil, err
 	}
-	allTheRankedNodes := index.GetRangeByRank(-1, 1, false)
-	payload := messages.ArticleCountsForDateRange{}
-	payload.StartDate = startdate
-	payload.EndDate = enddate
-	for _, node := range allTheRankedNodes {
-		payload.ArticleCounts = append(payload.ArticleCounts, node.Value)
+	if err := fetchRateLimiter.wait(ctx); err != nil {
+		pool.release()
+		return nil, err
 	}
+	return pool.release, nil
+}
 
-	return payload, nil
+// Function queryError reports why a query failed. Once ctx is done the individual day failures are just its
+// consequences, so a passed deadline is reported as ErrTimeout and a cancellation as ctx's error
+func queryError(ctx context.Context, err error) error {
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return fmt.Errorf("%w: %w", ErrTimeout, ctx.Err())
+	case ctx.Err() != nil:
+		return ctx.Err()
+	}
+	return err
 }
 
-// Function getArticleCountsForDay will check the db cache for the slice of article counts and if not found will
-// pull from the Wikipedia api
-func getArticleCountsForDay(day time.Time) ([]messages.ArticleCount, error) {
-	cachedcounts, ok := DB.Get(day)
-	if !ok {
-		fetchedCounts, err := Fetcher(day)
-		if err != nil {
-			return nil, err
+// Function getCachedCountsForDay reads a day from the db cache, logging storage failures as a miss
+func getCachedCountsForDay(ctx context.Context, key storage.Key) ([]messages.ArticleCount, bool, error) {
+	cachedcounts, ok, err := DB.Get(ctx, key)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, false, ctx.Err()
 		}
-		DB.Put(day, fetchedCounts)
-		return fetchedCounts, nil
+		log.Warnf("Unable to read %s from storage, fetching instead: %v", key, err)
+		return nil, false, nil
 	}
-	return cachedcounts, nil
+	return cachedcounts, ok, nil
 }
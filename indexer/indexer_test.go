@@ -1,18 +1,31 @@
 package indexer
 
 import (
+	"context"
+	"errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/zavitax/sortedset-go"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"pelotechfun/constants"
 	"pelotechfun/messages"
 	"pelotechfun/storage"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
+// The stub fetchers used here are free to call, so run without the outbound rate limit
+func TestMain(m *testing.M) {
+	SetFetchRateLimit(0, 0)
+	os.Exit(m.Run())
+}
+
 func Test_GetArticleCountsForDateRange_1year(t *testing.T) {
 	const NUM_DAILY_ARTICLES = 1000
 	mu := sync.Mutex{}
@@ -20,9 +33,9 @@ func Test_GetArticleCountsForDateRange_1year(t *testing.T) {
 	verificationMap := make(map[string]messages.ArticleCount)
 	//set a clean storage impl
 
-	DB = storage.NewLocalMapStorage()
+	DB = storage.Adapt(storage.NewLocalMapStorage())
 	//set a stub fetcher which will generate some fake data
-	Fetcher = func(date time.Time) ([]messages.ArticleCount, error) {
+	Fetcher = func(ctx context.Context, key storage.Key) ([]messages.ArticleCount, error) {
 		countsSlice := make([]messages.ArticleCount, NUM_DAILY_ARTICLES)
 		for i := 0; i < NUM_DAILY_ARTICLES; i++ {
 			countObject := messages.ArticleCount{
@@ -47,7 +60,7 @@ func Test_GetArticleCountsForDateRange_1year(t *testing.T) {
 	//call the indexer and check values
 	start, _ := time.Parse(constants.DATELAYOUT, "20210101")
 	end, _ := time.Parse(constants.DATELAYOUT, "20220101")
-	result, _ := GetArticleCountsForDateRange(start, end)
+	result, _ := GetArticleCountsForDateRange(context.Background(), constants.DEFAULT_PROJECT, constants.DEFAULT_ACCESS, start, end, false, Page{}, NameFilter{})
 	assert.NotNil(t, result)
 	assert.Equal(t, start.Year(), result.StartDate.Year())
 	assert.Equal(t, start.Month(), result.StartDate.Month())
@@ -74,9 +87,9 @@ func Test_GetCountsForArticleInRange_1year(t *testing.T) {
 	//keeps a running count of views per article. Will use to compare with api results
 	verificationMap := make(map[string]messages.ArticleCount)
 	//set a clean storage impl
-	DB = storage.NewLocalMapStorage()
+	DB = storage.Adapt(storage.NewLocalMapStorage())
 	//set a stub fetcher which will generate some fake data
-	Fetcher = func(date time.Time) ([]messages.ArticleCount, error) {
+	Fetcher = func(ctx context.Context, key storage.Key) ([]messages.ArticleCount, error) {
 		countsSlice := make([]messages.ArticleCount, NUM_DAILY_ARTICLES)
 		for i := 0; i < NUM_DAILY_ARTICLES; i++ {
 			countObject := messages.ArticleCount{
@@ -99,7 +112,7 @@ func Test_GetCountsForArticleInRange_1year(t *testing.T) {
 	}
 	start, _ := time.Parse(constants.DATELAYOUT, "20210101")
 	end, _ := time.Parse(constants.DATELAYOUT, "20220101")
-	result, err := GetCountsForArticleInRange(TARGET_ARTICLE, start, end)
+	result, err := GetCountsForArticleInRange(context.Background(), constants.DEFAULT_PROJECT, constants.DEFAULT_ACCESS, TARGET_ARTICLE, start, end, false)
 	if err != nil {
 		print(err)
 	}
@@ -122,6 +135,397 @@ func Test_GetCountsForArticleInRange_1year(t *testing.T) {
 	}
 }
 
+// failingStorage is a ContextStorage whose every call fails, used to check storage errors don't fail queries
+type failingStorage struct{}
+
+var errStorageDown = errors.New("storage down")
+
+func (failingStorage) Put(context.Context, storage.Key, []messages.ArticleCount) error {
+	return errStorageDown
+}
+func (failingStorage) Get(context.Context, storage.Key) ([]messages.ArticleCount, bool, error) {
+	return nil, false, errStorageDown
+}
+func (failingStorage) Delete(context.Context, storage.Key) error      { return errStorageDown }
+func (failingStorage) Has(context.Context, storage.Key) (bool, error) { return false, errStorageDown }
+func (failingStorage) Range(context.Context, func(storage.Key, []messages.ArticleCount) bool) error {
+	return errStorageDown
+}
+
+// A broken cache is treated as a miss, but a cancelled context aborts the lookup
+func Test_getArticleCountsForDay_StorageErrors(t *testing.T) {
+	DB = failingStorage{}
+	defer func() { DB = storage.Adapt(storage.NewLocalMapStorage()) }()
+	Fetcher = func(ctx context.Context, key storage.Key) ([]messages.ArticleCount, error) {
+		return []messages.ArticleCount{{Name: "Main_Page", Views: 7}}, nil
+	}
+	day, _ := time.Parse(constants.DATELAYOUT, "20210101")
+	counts, err := getArticleCountsForDay(context.Background(), enwiki(day))
+	assert.Nil(t, err)
+	assert.Equal(t, 7, counts[0].Views)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = getArticleCountsForDay(ctx, enwiki(day))
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+// Concurrent misses for the same day share a single call to the fetcher
+func Test_getArticleCountsForDay_CoalescesFetches(t *testing.T) {
+	const CALLERS = 50
+	DB = storage.Adapt(storage.NewLocalMapStorage())
+	release := make(chan struct{})
+	fetches := atomic.Int32{}
+	Fetcher = func(ctx context.Context, key storage.Key) ([]messages.ArticleCount, error) {
+		fetches.Add(1)
+		<-release
+		return []messages.ArticleCount{{Name: "Main_Page", Views: 7}}, nil
+	}
+	day, _ := time.Parse(constants.DATELAYOUT, "20210101")
+	wg := sync.WaitGroup{}
+	for i := 0; i < CALLERS; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			counts, err := getArticleCountsForDay(context.Background(), enwiki(day))
+			assert.Nil(t, err)
+			assert.Equal(t, 7, counts[0].Views)
+		}()
+	}
+	//give the callers time to pile up behind the first fetch before letting it finish
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), fetches.Load())
+}
+
+// A caller giving up doesn't cancel a fetch others still wait on, but the fetch is cancelled once nobody waits
+func Test_getArticleCountsForDay_SharedFetchCancellation(t *testing.T) {
+	DB = storage.Adapt(storage.NewLocalMapStorage())
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	cancelled := make(chan struct{}, 2)
+	Fetcher = func(ctx context.Context, key storage.Key) ([]messages.ArticleCount, error) {
+		started <- struct{}{}
+		select {
+		case <-release:
+			return []messages.ArticleCount{{Name: "Main_Page", Views: 7}}, nil
+		case <-ctx.Done():
+			cancelled <- struct{}{}
+			return nil, ctx.Err()
+		}
+	}
+	day, _ := time.Parse(constants.DATELAYOUT, "20210101")
+
+	leaving, leave := context.WithCancel(context.Background())
+	left := make(chan error)
+	go func() {
+		_, err := getArticleCountsForDay(leaving, enwiki(day))
+		left <- err
+	}()
+	<-started
+	staying := make(chan []messages.ArticleCount)
+	go func() {
+		counts, _ := getArticleCountsForDay(context.Background(), enwiki(day))
+		staying <- counts
+	}()
+	//give the second caller time to join the flight before the first leaves
+	time.Sleep(50 * time.Millisecond)
+	leave()
+	assert.ErrorIs(t, <-left, context.Canceled)
+	close(release)
+	assert.Equal(t, 7, (<-staying)[0].Views)
+	assert.Empty(t, cancelled)
+
+	//with every caller gone the fetch itself is cancelled
+	release = make(chan struct{})
+	alone, giveUp := context.WithCancel(context.Background())
+	go func() {
+		_, err := getArticleCountsForDay(alone, enwiki(day.AddDate(0, 0, 1)))
+		left <- err
+	}()
+	<-started
+	giveUp()
+	assert.ErrorIs(t, <-left, context.Canceled)
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("fetch was not cancelled")
+	}
+}
+
+// A query abandons its outstanding fetches when its context is cancelled, and reports a passed deadline as ErrTimeout
+func Test_ArticleQueries_Context(t *testing.T) {
+	DB = storage.Adapt(storage.NewLocalMapStorage())
+	running := atomic.Int32{}
+	Fetcher = func(ctx context.Context, key storage.Key) ([]messages.ArticleCount, error) {
+		running.Add(1)
+		defer running.Add(-1)
+		<-ctx.Done()
+		return nil, &FetchError{Project: key.Project, Access: key.Access, Date: key.Day, Err: ctx.Err()}
+	}
+	start, _ := time.Parse(constants.DATELAYOUT, "20210101")
+	end, _ := time.Parse(constants.DATELAYOUT, "20210110")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	_, err := GetArticleCountsForDateRange(ctx, constants.DEFAULT_PROJECT, constants.DEFAULT_ACCESS, start, end, false, Page{}, NameFilter{})
+	assert.Equal(t, context.Canceled, err)
+	assert.NotErrorIs(t, err, ErrTimeout)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	began := time.Now()
+	_, err = GetTopDayForArticle(ctx, constants.DEFAULT_PROJECT, constants.DEFAULT_ACCESS, "Main_Page", start, end, false)
+	assert.ErrorIs(t, err, ErrTimeout)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(began), time.Second)
+	_, err = GetAccessBreakdown(ctx, func(ctx context.Context, access string) (messages.ArticleCountsForDateRange, error) {
+		return GetTimeSeriesForArticle(ctx, constants.DEFAULT_PROJECT, access, "Main_Page", start, end, false)
+	})
+	assert.ErrorIs(t, err, ErrTimeout)
+
+	//nothing is left running once the queries return
+	assert.Eventually(t, func() bool { return running.Load() == 0 }, time.Second, 10*time.Millisecond)
+}
+
+// No more than the configured number of requests to Wikipedia run at once, however many days are requested
+func Test_GetArticleCountsForDateRange_FetchConcurrency(t *testing.T) {
+	const LIMIT = 3
+	SetFetchConcurrency(LIMIT)
+	defer SetFetchConcurrency(constants.DEFAULT_FETCH_CONCURRENCY)
+	DB = storage.Adapt(storage.NewLocalMapStorage())
+	running := atomic.Int32{}
+	maxRunning := atomic.Int32{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := running.Add(1)
+		defer running.Add(-1)
+		for {
+			seen := maxRunning.Load()
+			if now <= seen || maxRunning.CompareAndSwap(seen, now) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		//each day's list must be for the day asked for, so answer with the requested date
+		parts := strings.Split(r.URL.Path, "/")
+		w.Write([]byte(strings.Replace(onePagePayload, `"year":"2021","month":"01","day":"01"`,
+			`"year":"`+parts[4]+`","month":"`+parts[5]+`","day":"`+parts[6]+`"`, 1)))
+	}))
+	defer server.Close()
+	Fetcher = NewWikipediaFetcher(WikipediaFetcherConfig{BaseURL: server.URL}).Fetch
+	start, _ := time.Parse(constants.DATELAYOUT, "20210101")
+	end, _ := time.Parse(constants.DATELAYOUT, "20210130")
+	result, err := GetArticleCountsForDateRange(context.Background(), constants.DEFAULT_PROJECT, constants.DEFAULT_ACCESS, start, end, false, Page{}, NameFilter{})
+	assert.Nil(t, err)
+	assert.Equal(t, 30*42, result.ArticleCounts[0].Views)
+	assert.Equal(t, int32(LIMIT), maxRunning.Load())
+}
+
+// Each project is fetched and cached separately, so the same day on two wikis never mixes
+func Test_GetArticleCountsForDateRange_Projects(t *testing.T) {
+	DB = storage.Adapt(storage.NewLocalMapStorage())
+	fetches := atomic.Int32{}
+	Fetcher = func(ctx context.Context, key storage.Key) ([]messages.ArticleCount, error) {
+		fetches.Add(1)
+		return []messages.ArticleCount{{Name: "Main_Page of " + key.Project, Views: len(key.Project)}}, nil
+	}
+	start, _ := time.Parse(constants.DATELAYOUT, "20210101")
+	end, _ := time.Parse(constants.DATELAYOUT, "20210103")
+	for i := 0; i < 2; i++ {
+		for _, project := range []string{"en.wikipedia", "commons.wikimedia"} {
+			result, err := GetArticleCountsForDateRange(context.Background(), project, constants.DEFAULT_ACCESS, start, end, false, Page{}, NameFilter{})
+			assert.Nil(t, err)
+			assert.Equal(t, []messages.ArticleCount{{Name: "Main_Page of " + project, Views: 3 * len(project)}}, result.ArticleCounts)
+		}
+	}
+	//the second pass is served from the cache
+	assert.Equal(t, int32(6), fetches.Load())
+}
+
+// An article missing from the top list on any day is answered from its own series, and one with no data at all has
+// no results
+func Test_ArticleQueries_PerArticleFallback(t *testing.T) {
+	DB = storage.Adapt(storage.NewLocalMapStorage())
+	start, _ := time.Parse(constants.DATELAYOUT, "20210101")
+	Fetcher = func(ctx context.Context, key storage.Key) ([]messages.ArticleCount, error) {
+		//only in the top list on the first day
+		if key.Day.Equal(start) {
+			return []messages.ArticleCount{{Name: "Niche_Article", Views: 900}}, nil
+		}
+		return []messages.ArticleCount{{Name: "Main_Page", Views: 1000}}, nil
+	}
+	seriesCalls := 0
+	ArticleFetcher = func(ctx context.Context, project string, access string, article string, startdate time.Time, enddate time.Time) ([]messages.ArticleCount, error) {
+		seriesCalls++
+		if article != "Niche_Article" {
+			return nil, &FetchError{Project: project, Access: access, Article: article, Date: startdate, EndDate: enddate, Err: ErrNoData}
+		}
+		series := []messages.ArticleCount{}
+		for d := startdate; !d.After(enddate); d = d.AddDate(0, 0, 1) {
+			series = append(series, messages.ArticleCount{Name: article, Views: 100 * d.Day(), Date: d})
+		}
+		return series, nil
+	}
+	defer func() { ArticleFetcher = NewWikipediaFetcher(WikipediaFetcherConfig{}).FetchArticle }()
+
+	result, err := GetCountsForArticleInRange(context.Background(), constants.DEFAULT_PROJECT, constants.DEFAULT_ACCESS, "Niche_Article", start, start.AddDate(0, 0, 9), false)
+	assert.Nil(t, err)
+	assert.Equal(t, []messages.ArticleCount{{Name: "Niche_Article", Views: 5500}}, result.ArticleCounts)
+
+	result, err = GetTopDayForArticle(context.Background(), constants.DEFAULT_PROJECT, constants.DEFAULT_ACCESS, "Niche_Article", start, start.AddDate(0, 1, 0), false)
+	assert.Nil(t, err)
+	assert.Equal(t, []messages.ArticleCount{{Name: "Niche_Article", Views: 3100, Date: start.AddDate(0, 0, 30)}}, result.ArticleCounts)
+
+	result, err = GetCountsForArticleInRange(context.Background(), constants.DEFAULT_PROJECT, constants.DEFAULT_ACCESS, "foo_bar_baz", start, start.AddDate(0, 0, 9), false)
+	assert.Nil(t, err)
+	assert.Nil(t, result.ArticleCounts)
+
+	//an article in every day's top list never needs its series
+	seriesCalls = 0
+	result, err = GetCountsForArticleInRange(context.Background(), constants.DEFAULT_PROJECT, constants.DEFAULT_ACCESS, "Main_Page", start.AddDate(0, 0, 1), start.AddDate(0, 0, 9), false)
+	assert.Nil(t, err)
+	assert.Equal(t, 9000, result.ArticleCounts[0].Views)
+	assert.Equal(t, 0, seriesCalls)
+}
+
+// A time series has one dated entry per day: from the top lists if the article is in all of them, else from its own
+// series like any article query, and marked missing where Wikipedia has no data
+func Test_GetTimeSeriesForArticle(t *testing.T) {
+	DB = storage.Adapt(storage.NewLocalMapStorage())
+	start, _ := time.Parse(constants.DATELAYOUT, "20210101")
+	Fetcher = func(ctx context.Context, key storage.Key) ([]messages.ArticleCount, error) {
+		switch key.Day.Day() {
+		case 1:
+			return []messages.ArticleCount{{Name: "Main_Page", Views: 1000}, {Name: "Dua_Lipa", Views: 500}}, nil
+		case 3:
+			return nil, &FetchError{Date: key.Day, StatusCode: 404, Err: ErrNoData}
+		default:
+			return []messages.ArticleCount{{Name: "Main_Page", Views: 1000}}, nil
+		}
+	}
+	ArticleFetcher = func(ctx context.Context, project string, access string, article string, startdate time.Time, enddate time.Time) ([]messages.ArticleCount, error) {
+		//no views on the 4th
+		return []messages.ArticleCount{
+			{Name: article, Views: 499, Date: startdate},
+			{Name: article, Views: 42, Date: startdate.AddDate(0, 0, 1)},
+		}, nil
+	}
+	defer func() { ArticleFetcher = NewWikipediaFetcher(WikipediaFetcherConfig{}).FetchArticle }()
+
+	result, err := GetTimeSeriesForArticle(context.Background(), constants.DEFAULT_PROJECT, constants.DEFAULT_ACCESS, "Dua_Lipa", start, start.AddDate(0, 0, 3), false)
+	assert.Nil(t, err)
+	assert.Equal(t, []messages.ArticleCount{
+		{Name: "Dua_Lipa", Views: 499, Date: start},
+		{Name: "Dua_Lipa", Views: 42, Date: start.AddDate(0, 0, 1)},
+		{Name: "Dua_Lipa", Views: 0, Date: start.AddDate(0, 0, 2), Missing: true},
+		{Name: "Dua_Lipa", Views: 0, Date: start.AddDate(0, 0, 3)},
+	}, result.ArticleCounts)
+
+	//other failures still fail the call
+	Fetcher = func(ctx context.Context, key storage.Key) ([]messages.ArticleCount, error) {
+		return nil, &FetchError{Date: key.Day, StatusCode: 400, Err: errors.New("400 Bad Request")}
+	}
+	_, err = GetTimeSeriesForArticle(context.Background(), constants.DEFAULT_PROJECT, constants.DEFAULT_ACCESS, "Dua_Lipa", start.AddDate(1, 0, 0), start.AddDate(1, 0, 3), false)
+	assert.NotNil(t, err)
+
+	//unless partial results are asked for, when they are marked missing and listed
+	Fetcher = func(ctx context.Context, key storage.Key) ([]messages.ArticleCount, error) {
+		if key.Day.Day() == 2 {
+			return nil, &FetchError{Date: key.Day, StatusCode: 500, Err: errors.New("500 Internal Server Error")}
+		}
+		return []messages.ArticleCount{{Name: "Dua_Lipa", Views: 7}}, nil
+	}
+	result, err = GetTimeSeriesForArticle(context.Background(), constants.DEFAULT_PROJECT, constants.DEFAULT_ACCESS, "Dua_Lipa", start.AddDate(2, 0, 0), start.AddDate(2, 0, 2), true)
+	assert.Nil(t, err)
+	assert.Equal(t, []messages.ArticleCount{
+		{Name: "Dua_Lipa", Views: 7, Date: start.AddDate(2, 0, 0)},
+		{Name: "Dua_Lipa", Views: 0, Date: start.AddDate(2, 0, 1), Missing: true},
+		{Name: "Dua_Lipa", Views: 7, Date: start.AddDate(2, 0, 2)},
+	}, result.ArticleCounts)
+	assert.True(t, result.Incomplete)
+	assert.Equal(t, []time.Time{start.AddDate(2, 0, 1)}, result.MissingDays)
+}
+
+// A breakdown runs the query once per access method and returns the results keyed by method
+func Test_GetAccessBreakdown(t *testing.T) {
+	DB = storage.Adapt(storage.NewLocalMapStorage())
+	views := map[string]int{constants.ACCESS_DESKTOP: 3, constants.ACCESS_MOBILE_APP: 1, constants.ACCESS_MOBILE_WEB: 5}
+	Fetcher = func(ctx context.Context, key storage.Key) ([]messages.ArticleCount, error) {
+		return []messages.ArticleCount{{Name: "Main_Page", Views: views[key.Access]}}, nil
+	}
+	start, _ := time.Parse(constants.DATELAYOUT, "20210101")
+	end, _ := time.Parse(constants.DATELAYOUT, "20210102")
+	result, err := GetAccessBreakdown(context.Background(), func(ctx context.Context, access string) (messages.ArticleCountsForDateRange, error) {
+		return GetCountsForArticleInRange(context.Background(), constants.DEFAULT_PROJECT, access, "Main_Page", start, end, false)
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, start, result.StartDate)
+	assert.Equal(t, end, result.EndDate)
+	assert.Equal(t, 3, len(result.Access))
+	for access, perDay := range views {
+		assert.Equal(t, []messages.ArticleCount{{Name: "Main_Page", Views: 2 * perDay}}, result.Access[access])
+	}
+
+	//one failing access method fails the breakdown
+	Fetcher = func(ctx context.Context, key storage.Key) ([]messages.ArticleCount, error) {
+		if key.Access == constants.ACCESS_MOBILE_APP {
+			return nil, &FetchError{Project: key.Project, Access: key.Access, Date: key.Day, Err: ErrNoData}
+		}
+		return []messages.ArticleCount{}, nil
+	}
+	_, err = GetAccessBreakdown(context.Background(), func(ctx context.Context, access string) (messages.ArticleCountsForDateRange, error) {
+		return GetArticleCountsForDateRange(context.Background(), constants.DEFAULT_PROJECT, access, start.AddDate(1, 0, 0), end.AddDate(1, 0, 0), false, Page{}, NameFilter{})
+	})
+	assert.ErrorIs(t, err, ErrNoData)
+	assert.Contains(t, err.Error(), "for en.wikipedia mobile-app")
+
+	//partially, the breakdown is incomplete if any access method is
+	Fetcher = func(ctx context.Context, key storage.Key) ([]messages.ArticleCount, error) {
+		if key.Access == constants.ACCESS_MOBILE_APP && key.Day.Day() == 2 {
+			return nil, &FetchError{Project: key.Project, Access: key.Access, Date: key.Day, Err: ErrNoData}
+		}
+		return []messages.ArticleCount{{Name: "Main_Page", Views: views[key.Access]}}, nil
+	}
+	result, err = GetAccessBreakdown(context.Background(), func(ctx context.Context, access string) (messages.ArticleCountsForDateRange, error) {
+		return GetArticleCountsForDateRange(context.Background(), constants.DEFAULT_PROJECT, access, start.AddDate(2, 0, 0), end.AddDate(2, 0, 0), true, Page{}, NameFilter{})
+	})
+	assert.Nil(t, err)
+	assert.True(t, result.Incomplete)
+	assert.Equal(t, []time.Time{end.AddDate(2, 0, 0)}, result.MissingDays)
+	assert.Equal(t, []messages.ArticleCount{{Name: "Main_Page", Views: 1}}, result.Access[constants.ACCESS_MOBILE_APP])
+	assert.Equal(t, []messages.ArticleCount{{Name: "Main_Page", Views: 6}}, result.Access[constants.ACCESS_DESKTOP])
+}
+
+// enwiki keys a day of English Wikipedia across all access methods
+func enwiki(day time.Time) storage.Key {
+	return storage.NewKey(constants.DEFAULT_PROJECT, constants.DEFAULT_ACCESS, day)
+}
+
+// Calls beyond the burst are spaced out at the configured rate, and a cancelled wait hands its token back
+func Test_tokenBucket(t *testing.T) {
+	now := time.Now()
+	bucket := newTokenBucket(10, 2)
+	bucket.now = func() time.Time { return now }
+	bucket.last = now
+	assert.Equal(t, time.Duration(0), bucket.reserve())
+	assert.Equal(t, time.Duration(0), bucket.reserve())
+	assert.Equal(t, 100*time.Millisecond, bucket.reserve())
+	assert.Equal(t, 200*time.Millisecond, bucket.reserve())
+	bucket.cancel()
+	bucket.cancel()
+	//a second later the bucket has refilled, but only up to the burst
+	now = now.Add(time.Second)
+	assert.Equal(t, time.Duration(0), bucket.reserve())
+	assert.Equal(t, time.Duration(0), bucket.reserve())
+	assert.Equal(t, 100*time.Millisecond, bucket.reserve())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, bucket.wait(ctx), context.Canceled)
+	assert.Equal(t, time.Duration(0), newTokenBucket(0, 0).reserve())
+}
+
 func xTest_ssplayground(t *testing.T) {
 	index := sortedset.New[string, int, messages.ArticleCount]()
 	index.AddOrUpdate("article1", 900, messages.ArticleCount{
@@ -0,0 +1,87 @@
+package indexer
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"pelotechfun/constants"
+	"pelotechfun/messages"
+	"pelotechfun/storage"
+	"time"
+)
+
+// ErrMalformedPayload is wrapped by fetch errors for 200 responses that can't be used: bad JSON, a missing item, an
+// item for another project, access method or day than asked for, unnamed articles or impossible view counts. Unlike ErrNoData this
+// points at a fault upstream (or in between), so it counts against the circuit breaker
+var ErrMalformedPayload = errors.New("malformed response")
+
+// malformed wraps ErrMalformedPayload with the reason a payload was rejected
+func malformed(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrMalformedPayload, fmt.Sprintf(format, args...))
+}
+
+// validateTopPayload checks a top endpoint payload answers the request for key and maps it to article counts
+func validateTopPayload(payload messages.WPPageViewsPayload, key storage.Key) ([]messages.ArticleCount, error) {
+	if len(payload.Items) != 1 {
+		return nil, malformed("expected 1 item, got %d", len(payload.Items))
+	}
+	item := payload.Items[0]
+	if item.Project != key.Project || item.Access != key.Access {
+		return nil, malformed("item is for %s %s", item.Project, item.Access)
+	}
+	day, err := time.Parse("2006/01/02", item.Year+"/"+item.Month+"/"+item.Day)
+	if err != nil || !day.Equal(key.Day.Truncate(24*time.Hour)) {
+		return nil, malformed("item is for day %s/%s/%s", item.Year, item.Month, item.Day)
+	}
+	counts := make([]messages.ArticleCount, 0, len(item.Articles))
+	//the top lists occasionally repeat a title, so those rows are merged rather than failing the day
+	seen := make(map[string]int, len(item.Articles))
+	for _, article := range item.Articles {
+		switch {
+		case len(article.Article) == 0:
+			return nil, malformed("article without a name")
+		case article.Views < 0:
+			return nil, malformed("%d views for %s", article.Views, article.Article)
+		}
+		if i, ok := seen[article.Article]; ok {
+			log.Warnf("%s is listed twice in the top list for %s, keeping the higher count", article.Article, key)
+			counts[i].Views = max(counts[i].Views, article.Views)
+			continue
+		}
+		seen[article.Article] = len(counts)
+		counts = append(counts, messages.ArticleCount{Name: article.Article, Views: article.Views})
+	}
+	return counts, nil
+}
+
+// validatePerArticlePayload checks a per-article endpoint payload answers the request for article's views from start
+// to end inclusive and maps it to one count per day
+func validatePerArticlePayload(payload messages.WPPerArticlePayload, project string, access string, article string,
+	start time.Time, end time.Time) ([]messages.ArticleCount, error) {
+	start, end = start.Truncate(24*time.Hour), end.Truncate(24*time.Hour)
+	counts := make([]messages.ArticleCount, 0, len(payload.Items))
+	seen := make(map[time.Time]bool, len(payload.Items))
+	for _, item := range payload.Items {
+		if item.Project != project || item.Access != access || item.Article != article {
+			return nil, malformed("item is for %s %s article %s", item.Project, item.Access, item.Article)
+		}
+		if item.Granularity != "daily" {
+			return nil, malformed("item has %s granularity", item.Granularity)
+		}
+		//timestamps are YYYYMMDDHH, with the hour always 00 at daily granularity
+		day, err := time.Parse(constants.DATELAYOUT+"15", item.Timestamp)
+		switch {
+		case err != nil || day.Hour() != 0:
+			return nil, malformed("bad timestamp %q", item.Timestamp)
+		case day.Before(start) || day.After(end):
+			return nil, malformed("timestamp %s is outside the range asked for", item.Timestamp)
+		case seen[day]:
+			return nil, malformed("timestamp %s listed twice", item.Timestamp)
+		case item.Views < 0:
+			return nil, malformed("%d views on %s", item.Views, item.Timestamp)
+		}
+		seen[day] = true
+		counts = append(counts, messages.ArticleCount{Name: article, Views: item.Views, Date: day})
+	}
+	return counts, nil
+}
@@ -0,0 +1,88 @@
+package indexer
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/metric"
+	"sync"
+	"time"
+)
+
+var rateLimitWaitTime, _ = Meter.Float64Histogram(
+	"indexer_rate_limit_wait_time",
+	metric.WithUnit("s"),
+	metric.WithDescription("time requests to Wikipedia spent waiting on the outbound rate limiter"),
+)
+
+// tokenBucket is a rate limiter that allows rate calls per second on average with bursts of up to burst calls. It
+// hands out reservations, so waiters are served in arrival order without polling
+type tokenBucket struct {
+	mutex  sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+// newTokenBucket makes a limiter that starts full. A rate of zero or less disables limiting
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+		now:    time.Now,
+	}
+}
+
+// reserve takes a token, possibly going into debt, and returns how long the caller must wait before using it
+func (b *tokenBucket) reserve() time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	now := b.now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// cancel hands back a reserved token that was never used
+func (b *tokenBucket) cancel() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.tokens = min(b.burst, b.tokens+1)
+}
+
+// wait blocks until the caller may make a call or ctx is done
+func (b *tokenBucket) wait(ctx context.Context) error {
+	delay := b.reserve()
+	rateLimitWaitTime.Record(ctx, delay.Seconds())
+	if delay == 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		b.cancel()
+		return ctx.Err()
+	}
+}
+
+// Function SetFetchRateLimit sets the rate (requests per second) and burst of HTTP requests to Wikipedia shared by all
+// queries, each retry counting as a request. A rate of zero or less removes the limit. It is meant to be called once at
+// startup
+func SetFetchRateLimit(rate float64, burst int) {
+	fetchRateLimiter = newTokenBucket(rate, burst)
+}
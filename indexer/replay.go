@@ -0,0 +1,152 @@
+package indexer
+
+import (
+	"bytes"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// fixtureExt ends every recorded response file. Responses other than 200 OK carry their status before it, e.g.
+// top/en.wikipedia/all-access/2001/01/01.404.json
+const fixtureExt = ".json"
+
+// Type RecordingTransport is an http.RoundTripper that passes requests on to the real Pageviews API and saves every
+// response body under a fixtures directory, so it can be served back later by a ReplayTransport. Transient failures
+// (429 and 5xx) are passed through but not saved. Use it as the Transport of WikipediaFetcherConfig.Client
+type RecordingTransport struct {
+	dir  string
+	root string
+	next http.RoundTripper
+}
+
+// Function NewRecordingTransport creates a RecordingTransport saving to dir. Fixtures are named after the request path
+// below baseURL, e.g. top/en.wikipedia/all-access/2022/01/01.json. next makes the real calls and defaults to
+// http.DefaultTransport
+func NewRecordingTransport(dir string, baseURL string, next http.RoundTripper) *RecordingTransport {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &RecordingTransport{dir: dir, root: fixtureRoot(baseURL), next: next}
+}
+
+func (t *RecordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return resp, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	path, err := fixturePath(t.dir, t.root, req.URL, resp.StatusCode)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(path), 0o755)
+	}
+	if err == nil {
+		err = os.WriteFile(path, body, 0o644)
+	}
+	if err != nil {
+		log.Warnf("Unable to record response for %s: %v", req.URL, err)
+	}
+	return resp, nil
+}
+
+// Type ReplayTransport is an http.RoundTripper that serves responses saved by a RecordingTransport and never touches
+// the network. A request with no recording fails, so tests notice rather than silently going live
+type ReplayTransport struct {
+	dir  string
+	root string
+}
+
+// Function NewReplayTransport creates a ReplayTransport serving recordings from dir made with the same baseURL
+func NewReplayTransport(dir string, baseURL string) *ReplayTransport {
+	return &ReplayTransport{dir: dir, root: fixtureRoot(baseURL)}
+}
+
+func (t *ReplayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	path, err := fixturePath(t.dir, t.root, req.URL, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	status := http.StatusOK
+	body, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		status, path = recordedFailure(path)
+		if status == 0 {
+			return nil, fmt.Errorf("no recorded response for %s in %s", req.URL.Path, t.dir)
+		}
+		body, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		Status:        strconv.Itoa(status) + " " + http.StatusText(status),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// fixtureRoot is the path of the API root that fixture names are relative to
+func fixtureRoot(baseURL string) string {
+	parsed, err := url.Parse(baseURL)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(parsed.EscapedPath(), "/")
+}
+
+// fixturePath maps a request to its recording. Path elements stay escaped, so an article such as AC/DC is one file
+func fixturePath(dir string, root string, u *url.URL, status int) (string, error) {
+	path := strings.TrimPrefix(strings.TrimPrefix(u.EscapedPath(), root), "/")
+	elements := strings.Split(path, "/")
+	for _, element := range elements {
+		if len(element) == 0 || element == "." || element == ".." {
+			return "", fmt.Errorf("cannot record or replay %s", u.Path)
+		}
+	}
+	path = filepath.Join(append([]string{dir}, elements...)...)
+	if status != http.StatusOK {
+		path = path + "." + strconv.Itoa(status)
+	}
+	return path + fixtureExt, nil
+}
+
+// recordedFailure looks next to the 200 OK fixture path for a recorded failure such as 01.404.json, returning its
+// status and path, or a zero status if there is none
+func recordedFailure(path string) (int, string) {
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return 0, ""
+	}
+	prefix := strings.TrimSuffix(filepath.Base(path), fixtureExt) + "."
+	for _, entry := range entries {
+		code, ok := strings.CutPrefix(entry.Name(), prefix)
+		if !ok {
+			continue
+		}
+		code, ok = strings.CutSuffix(code, fixtureExt)
+		if status, err := strconv.Atoi(code); ok && err == nil && len(code) == 3 {
+			return status, filepath.Join(filepath.Dir(path), entry.Name())
+		}
+	}
+	return 0, ""
+}
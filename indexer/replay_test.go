@@ -0,0 +1,74 @@
+package indexer
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"pelotechfun/constants"
+	"testing"
+	"time"
+)
+
+func Test_RecordAndReplay(t *testing.T) {
+	day, _ := time.Parse(constants.DATELAYOUT, "20210101")
+	missing := day.AddDate(0, 0, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/top/en.wikipedia/all-access/2021/01/01" {
+			w.Write([]byte(onePagePayload))
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	baseURL := server.URL + "/api"
+
+	recorder := NewWikipediaFetcher(WikipediaFetcherConfig{
+		BaseURL: baseURL,
+		Client:  &http.Client{Transport: NewRecordingTransport(dir, baseURL, nil)},
+	})
+	counts, err := recorder.Fetch(context.Background(), enwiki(day))
+	assert.Nil(t, err)
+	assert.Equal(t, 42, counts[0].Views)
+	_, err = recorder.Fetch(context.Background(), enwiki(missing))
+	assert.ErrorIs(t, err, ErrNoData)
+	assert.FileExists(t, filepath.Join(dir, "top", "en.wikipedia", "all-access", "2021", "01", "01.json"))
+	assert.FileExists(t, filepath.Join(dir, "top", "en.wikipedia", "all-access", "2021", "01", "02.404.json"))
+
+	//replay must not need the server, and may use a different host for the same API root
+	server.Close()
+	replayURL := "http://replay.invalid/api"
+	replayer := NewWikipediaFetcher(WikipediaFetcherConfig{
+		BaseURL: replayURL,
+		Client:  &http.Client{Transport: NewReplayTransport(dir, replayURL)},
+	})
+	counts, err = replayer.Fetch(context.Background(), enwiki(day))
+	assert.Nil(t, err)
+	assert.Equal(t, 42, counts[0].Views)
+	_, err = replayer.Fetch(context.Background(), enwiki(missing))
+	assert.ErrorIs(t, err, ErrNoData)
+
+	//an unrecorded request fails rather than going live
+	_, err = replayer.Fetch(context.Background(), enwiki(day.AddDate(0, 0, 2)))
+	assert.NotNil(t, err)
+	assert.NotErrorIs(t, err, ErrNoData)
+	assert.Contains(t, err.Error(), "no recorded response")
+}
+
+func Test_RecordingTransport_SkipsTransientFailures(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	client := &http.Client{Transport: NewRecordingTransport(dir, server.URL, nil)}
+	resp, err := client.Get(server.URL + "/top/en.wikipedia/all-access/2021/01/01")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	entries, _ := os.ReadDir(dir)
+	assert.Empty(t, entries)
+}
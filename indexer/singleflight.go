@@ -0,0 +1,77 @@
+package indexer
+
+import (
+	"context"
+	"pelotechfun/messages"
+	"sync"
+)
+
+// flight is a fetch in progress for one key. done is closed once result and err are set. waiters counts the callers
+// still waiting on it, and cancel stops the fetch once none are
+type flight struct {
+	done    chan struct{}
+	result  []messages.ArticleCount
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// flightGroup de-duplicates concurrent fetches: while a fetch for a key is in progress, later callers for the same
+// key wait for and share its result instead of starting their own. Nothing is remembered once the fetch completes;
+// caching is the job of the Storage
+type flightGroup struct {
+	mutex   sync.Mutex
+	flights map[string]*flight
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{flights: make(map[string]*flight)}
+}
+
+// Do runs fn for key unless a call for key is already in flight, in which case it waits for that call's result.
+// shared reports whether the result came from another caller's call. A caller whose ctx is done gives up waiting
+// with ctx's error. The call carries on for everyone else still waiting, and its context is cancelled once nobody is
+func (g *flightGroup) Do(ctx context.Context, key string, fn func(ctx context.Context) ([]messages.ArticleCount, error)) (result []messages.ArticleCount, err error, shared bool) {
+	g.mutex.Lock()
+	f, shared := g.flights[key]
+	if !shared {
+		//the call outlives the caller that started it if others are waiting, so only the group may cancel it
+		flightCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		f = &flight{done: make(chan struct{}), cancel: cancel}
+		g.flights[key] = f
+		go g.run(flightCtx, key, f, fn)
+	}
+	f.waiters++
+	g.mutex.Unlock()
+
+	select {
+	case <-f.done:
+		return f.result, f.err, shared
+	case <-ctx.Done():
+		g.mutex.Lock()
+		f.waiters--
+		if f.waiters == 0 {
+			f.cancel()
+			//later callers start afresh rather than joining a cancelled call
+			if g.flights[key] == f {
+				delete(g.flights, key)
+			}
+		}
+		g.mutex.Unlock()
+		return nil, ctx.Err(), shared
+	}
+}
+
+// run makes the call for a flight and hands its result to the waiters
+func (g *flightGroup) run(ctx context.Context, key string, f *flight, fn func(ctx context.Context) ([]messages.ArticleCount, error)) {
+	defer func() {
+		g.mutex.Lock()
+		if g.flights[key] == f {
+			delete(g.flights, key)
+		}
+		g.mutex.Unlock()
+		f.cancel()
+		close(f.done)
+	}()
+	f.result, f.err = fn(ctx)
+}
@@ -0,0 +1,330 @@
+package indexer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"pelotechfun/constants"
+	"pelotechfun/messages"
+	"pelotechfun/storage"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrNoData is wrapped by fetch errors for days the upstream API has no data for (e.g. before records began). These
+// are never retried
+var ErrNoData = errors.New("no data for this day")
+
+// Type FetchError is returned when page count data cannot be retrieved, either for the top articles of a day or, when
+// Article is set, for one article's views from Date to EndDate. StatusCode is the last HTTP status received, or 0 if
+// the request never got a response
+type FetchError struct {
+	Project    string
+	Access     string
+	Article    string
+	Date       time.Time
+	EndDate    time.Time
+	StatusCode int
+	Err        error
+}
+
+func (e *FetchError) Error() string {
+	message := "Unable to retrieve page count data from Wikipedia: " + e.Date.Format(constants.DATELAYOUT)
+	if !e.EndDate.IsZero() {
+		message = message + "-" + e.EndDate.Format(constants.DATELAYOUT)
+	}
+	if len(e.Project) > 0 {
+		message = message + " for " + e.Project
+		if len(e.Access) > 0 {
+			message = message + " " + e.Access
+		}
+	}
+	if len(e.Article) > 0 {
+		message = message + " article " + e.Article
+	}
+	if e.Err != nil {
+		message = message + " (" + e.Err.Error() + ")"
+	}
+	return message
+}
+
+func (e *FetchError) Unwrap() error {
+	return e.Err
+}
+
+// Type RetryPolicy controls how transient fetch failures (5xx, 429, connection resets, timeouts) are retried. Delays
+// grow exponentially from BaseDelay up to MaxDelay and are fully jittered, i.e. a random duration between zero and
+// the exponential delay, so replicas retrying the same outage spread out. A Retry-After header from the server is
+// honored instead when present; if it asks for longer than MaxDelay the fetch gives up
+type RetryPolicy struct {
+	// MaxAttempts is the total number of tries, including the first. Values below 1 mean a single try
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+var (
+	//Var DefaultRetryPolicy makes up to 4 attempts, backing off from 250ms to at most 10s
+	DefaultRetryPolicy = RetryPolicy{
+		MaxAttempts: 4,
+		BaseDelay:   250 * time.Millisecond,
+		MaxDelay:    10 * time.Second,
+	}
+	//sleep is swapped out in tests so retries don't slow them down
+	sleep = sleepContext
+)
+
+// Type WikipediaFetcherConfig holds the settings for a WikipediaFetcher. Zero values take the defaults noted
+type WikipediaFetcherConfig struct {
+	// Client makes the HTTP calls. Defaults to http.DefaultClient
+	Client *http.Client
+	// BaseURL is the root of the Pageviews API, so a local mirror or test server can be used.
+	// Defaults to constants.PAGEVIEWS_BASE_URL
+	BaseURL string
+	// UserAgent identifies us to Wikimedia, whose API policy requires contact details.
+	// Defaults to constants.DEFAULT_USER_AGENT
+	UserAgent string
+	// Timeout bounds each HTTP attempt, not the fetch as a whole. Zero means no timeout beyond the Client's own
+	Timeout time.Duration
+	// Retry controls retries of transient failures. Defaults to DefaultRetryPolicy
+	Retry RetryPolicy
+}
+
+// Type WikipediaFetcher fetches daily top article counts, and the daily views of single articles, for any Wikimedia
+// project from the Pageviews API
+type WikipediaFetcher struct {
+	config WikipediaFetcherConfig
+}
+
+// Function NewWikipediaFetcher creates a fetcher, filling in defaults for unset config. Use its Fetch method as the
+// indexer's Fetcher and its FetchArticle method as the indexer's ArticleFetcher
+func NewWikipediaFetcher(config WikipediaFetcherConfig) *WikipediaFetcher {
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+	if len(config.BaseURL) == 0 {
+		config.BaseURL = constants.PAGEVIEWS_BASE_URL
+	}
+	config.BaseURL = strings.TrimSuffix(config.BaseURL, "/")
+	if len(config.UserAgent) == 0 {
+		config.UserAgent = constants.DEFAULT_USER_AGENT
+	}
+	if config.Retry == (RetryPolicy{}) {
+		config.Retry = DefaultRetryPolicy
+	}
+	return &WikipediaFetcher{config: config}
+}
+
+// backoff returns the jittered delay to wait before retry number attempt (starting at 1)
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.MaxDelay
+	if shift := attempt - 1; shift < 32 && p.BaseDelay<<shift < p.MaxDelay && p.BaseDelay<<shift > 0 {
+		delay = p.BaseDelay << shift
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return rand.N(delay + 1)
+}
+
+// Fetch gets the top articles for a project day through one access method. Transient failures are retried according
+// to the config's RetryPolicy until ctx is done
+func (f *WikipediaFetcher) Fetch(ctx context.Context, key storage.Key) ([]messages.ArticleCount, error) {
+	date := key.Day
+	year := strconv.Itoa(date.Year())
+	month := date.Format(constants.TWODAYMONTH)
+	day := date.Format(constants.TWODAYDAYOFWEEK)
+	topURL := f.config.BaseURL + fmt.Sprintf(constants.PAGEVIEWS_TOP_PATH, url.PathEscape(key.Project), url.PathEscape(key.Access), year, month, day)
+	body, err := f.get(ctx, topURL, FetchError{Project: key.Project, Access: key.Access, Date: key.Day})
+	if err != nil {
+		return []messages.ArticleCount{}, err
+	}
+
+	//Map body into struct representation and check it answers what was asked, return an error if either fails
+	responseStruct := messages.WPPageViewsPayload{}
+	counts := []messages.ArticleCount{}
+	if err = json.Unmarshal(body, &responseStruct); err != nil {
+		err = malformed("%v", err)
+	} else {
+		counts, err = validateTopPayload(responseStruct, key)
+	}
+	if err != nil {
+		return []messages.ArticleCount{}, rejectPayload(FetchError{Project: key.Project, Access: key.Access, Date: key.Day}, err)
+	}
+	return counts, nil
+}
+
+// FetchArticle gets one article's daily views from startdate to enddate inclusive in a single call to the per-article
+// endpoint, which unlike the top lists covers every article. Returns one count per day with Date set; days without
+// views are left out. Transient failures are retried according to the config's RetryPolicy until ctx is done
+func (f *WikipediaFetcher) FetchArticle(ctx context.Context, project string, access string, article string, startdate time.Time, enddate time.Time) ([]messages.ArticleCount, error) {
+	articleURL := f.config.BaseURL + fmt.Sprintf(constants.PAGEVIEWS_PER_ARTICLE_PATH, url.PathEscape(project), url.PathEscape(access),
+		url.PathEscape(article), startdate.Format(constants.DATELAYOUT), enddate.Format(constants.DATELAYOUT))
+	body, err := f.get(ctx, articleURL, FetchError{Project: project, Access: access, Article: article, Date: startdate, EndDate: enddate})
+	if err != nil {
+		return []messages.ArticleCount{}, err
+	}
+	responseStruct := messages.WPPerArticlePayload{}
+	counts := []messages.ArticleCount{}
+	if err = json.Unmarshal(body, &responseStruct); err != nil {
+		err = malformed("%v", err)
+	} else {
+		counts, err = validatePerArticlePayload(responseStruct, project, access, article, startdate, enddate)
+	}
+	if err != nil {
+		return []messages.ArticleCount{}, rejectPayload(FetchError{Project: project, Access: access, Article: article,
+			Date: startdate, EndDate: enddate}, err)
+	}
+	return counts, nil
+}
+
+// rejectPayload reports a 200 response that failed validation as a copy of fetchErr
+func rejectPayload(fetchErr FetchError, err error) error {
+	fetchErr.StatusCode = http.StatusOK
+	fetchErr.Err = err
+	log.Error(fetchErr.Error())
+	return &fetchErr
+}
+
+// get calls the Pageviews API, retrying transient failures according to the config's RetryPolicy, and returns the
+// response body. Every attempt goes through throttle, so retries count against the shared fetch pool and rate limit
+// like first tries do. Failures are reported as copies of fetchErr filled in with the status and cause. A done ctx
+// stops the call and any retries, failing with ctx's error
+func (f *WikipediaFetcher) get(ctx context.Context, url string, fetchErr FetchError) ([]byte, error) {
+	retry := f.config.Retry
+	for attempt := 1; ; attempt++ {
+		release, err := throttle(ctx)
+		if err != nil {
+			fetchErr.Err = err
+			return nil, &fetchErr
+		}
+		body, retryAfter, err := f.getOnce(ctx, url, fetchErr)
+		release()
+		if err == nil {
+			return body, nil
+		}
+		if retryAfter < 0 || attempt >= retry.MaxAttempts {
+			log.Error(err.Error())
+			return nil, err
+		}
+		delay := retry.backoff(attempt)
+		if retryAfter > 0 {
+			if retryAfter > retry.MaxDelay {
+				log.Error(err.Error())
+				return nil, err
+			}
+			delay = retryAfter
+		}
+		log.Warnf("Retrying in %v after attempt %d: %v", delay, attempt, err)
+		if ctxErr := sleep(ctx, delay); ctxErr != nil {
+			fetchErr.Err = ctxErr
+			return nil, &fetchErr
+		}
+	}
+}
+
+// sleepContext waits for d, or until ctx is done in which case it returns ctx's error
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// getOnce makes a single call to the Pageviews API. On failure retryAfter says whether to retry: negative
+// means the error is permanent, zero means retry using the backoff policy and positive is the delay the server asked for
+func (f *WikipediaFetcher) getOnce(ctx context.Context, url string, fetchErr FetchError) (body []byte, retryAfter time.Duration, err error) {
+	attemptCtx := ctx
+	if f.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		attemptCtx, cancel = context.WithTimeout(ctx, f.config.Timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(attemptCtx, http.MethodGet, url, nil)
+	if err != nil {
+		fetchErr.Err = err
+		return nil, -1, &fetchErr
+	}
+	req.Header.Set("User-Agent", f.config.UserAgent)
+	req.Header.Set("Accept", "application/json")
+	resp, err := f.config.Client.Do(req)
+	if err != nil {
+		//only the attempt timing out is worth retrying, not the caller giving up
+		if ctx.Err() != nil {
+			fetchErr.Err = ctx.Err()
+			return nil, -1, &fetchErr
+		}
+		if !isTransient(err) {
+			retryAfter = -1
+		}
+		fetchErr.Err = err
+		return nil, retryAfter, &fetchErr
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fetchErr.StatusCode = resp.StatusCode
+		fetchErr.Err = errors.New(resp.Status)
+		switch {
+		case resp.StatusCode == http.StatusNotFound:
+			fetchErr.Err = ErrNoData
+			return nil, -1, &fetchErr
+		case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+			return nil, parseRetryAfter(resp.Header.Get("Retry-After")), &fetchErr
+		default:
+			return nil, -1, &fetchErr
+		}
+	}
+	body, err = io.ReadAll(resp.Body)
+	if err != nil {
+		//the connection dropped mid-body; a partial body must not reach the JSON decoder
+		fetchErr.StatusCode = resp.StatusCode
+		fetchErr.Err = err
+		if ctx.Err() != nil {
+			fetchErr.Err = ctx.Err()
+			retryAfter = -1
+		} else if !isTransient(err) {
+			retryAfter = -1
+		}
+		return nil, retryAfter, &fetchErr
+	}
+	return body, 0, nil
+}
+
+// isTransient reports whether a transport error is worth retrying: timeouts, resets and connections dropped mid-response
+func isTransient(err error) bool {
+	var netErr net.Error
+	return (errors.As(err, &netErr) && netErr.Timeout()) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.EOF)
+}
+
+// parseRetryAfter reads a Retry-After header given either in seconds or as an HTTP date. Zero means absent or unparseable
+func parseRetryAfter(header string) time.Duration {
+	if len(header) == 0 {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay
+		}
+	}
+	return 0
+}
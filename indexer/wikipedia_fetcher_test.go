@@ -0,0 +1,379 @@
+package indexer
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"pelotechfun/constants"
+	"pelotechfun/messages"
+	"pelotechfun/storage"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const onePagePayload = `{"items":[{"project":"en.wikipedia","access":"all-access","year":"2021","month":"01","day":"01",` +
+	`"articles":[{"article":"Main_Page","views":42,"rank":1}]}]}`
+
+// stubPageviews starts an httptest server that replies with the given statuses in turn (200s carry onePagePayload),
+// and makes a fetcher pointed at it that records requested sleeps instead of sleeping. Returns the fetcher, attempt
+// counter and sleeps
+func stubPageviews(t *testing.T, retryAfter string, statuses ...int) (*WikipediaFetcher, *atomic.Int32, *[]time.Duration) {
+	attempts := &atomic.Int32{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := statuses[min(int(attempts.Add(1))-1, len(statuses)-1)]
+		if len(retryAfter) > 0 {
+			w.Header().Set("Retry-After", retryAfter)
+		}
+		w.WriteHeader(status)
+		if status == http.StatusOK {
+			w.Write([]byte(onePagePayload))
+		}
+	}))
+	sleeps := &[]time.Duration{}
+	originalSleep := sleep
+	sleep = func(ctx context.Context, d time.Duration) error {
+		*sleeps = append(*sleeps, d)
+		return nil
+	}
+	t.Cleanup(func() {
+		server.Close()
+		sleep = originalSleep
+	})
+	fetcher := NewWikipediaFetcher(WikipediaFetcherConfig{
+		BaseURL: server.URL,
+		Retry:   RetryPolicy{MaxAttempts: 4, BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second},
+	})
+	return fetcher, attempts, sleeps
+}
+
+func Test_wikipediafetcher_Retry(t *testing.T) {
+	day, _ := time.Parse(constants.DATELAYOUT, "20210101")
+	tests := []struct {
+		name         string
+		retryAfter   string
+		statuses     []int
+		wantAttempts int32
+		wantErr      bool
+		wantNoData   bool
+		wantSleeps   []time.Duration
+	}{
+		{name: "success first try", statuses: []int{200}, wantAttempts: 1},
+		{name: "recovers from 5xx", statuses: []int{503, 500, 200}, wantAttempts: 3},
+		{name: "recovers from 429 honoring Retry-After", retryAfter: "1", statuses: []int{429, 200}, wantAttempts: 2,
+			wantSleeps: []time.Duration{time.Second}},
+		{name: "gives up after max attempts", statuses: []int{502}, wantAttempts: 4, wantErr: true},
+		{name: "gives up when Retry-After exceeds max delay", retryAfter: "120", statuses: []int{503, 200},
+			wantAttempts: 1, wantErr: true},
+		{name: "404 fails fast", statuses: []int{404}, wantAttempts: 1, wantErr: true, wantNoData: true},
+		{name: "other 4xx fails fast", statuses: []int{400}, wantAttempts: 1, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fetcher, attempts, sleeps := stubPageviews(t, test.retryAfter, test.statuses...)
+			counts, err := fetcher.Fetch(context.Background(), enwiki(day))
+			assert.Equal(t, test.wantAttempts, attempts.Load())
+			assert.Equal(t, test.wantErr, err != nil)
+			assert.Equal(t, test.wantNoData, err != nil && errors.Is(err, ErrNoData))
+			if !test.wantErr {
+				assert.Equal(t, 42, counts[0].Views)
+			} else {
+				assert.Contains(t, err.Error(), "Unable to retrieve page count data from Wikipedia: 20210101")
+			}
+			assert.Equal(t, int(test.wantAttempts)-1, len(*sleeps))
+			if test.wantSleeps != nil {
+				assert.Equal(t, test.wantSleeps, *sleeps)
+			}
+			for _, d := range *sleeps {
+				assert.LessOrEqual(t, d, time.Second)
+			}
+		})
+	}
+}
+
+// Every attempt, retries included, takes a token from the outbound rate limiter, so a run of 503s can't exceed the
+// configured rate
+func Test_WikipediaFetcher_RateLimitsRetries(t *testing.T) {
+	now := time.Now()
+	bucket := newTokenBucket(1, 10)
+	//a frozen clock never refills the bucket, so tokens left tell how many were taken
+	bucket.now = func() time.Time { return now }
+	bucket.last = now
+	fetchRateLimiter = bucket
+	defer SetFetchRateLimit(0, 0)
+	day, _ := time.Parse(constants.DATELAYOUT, "20210101")
+
+	fetcher, attempts, _ := stubPageviews(t, "", http.StatusServiceUnavailable)
+	_, err := fetcher.Fetch(context.Background(), enwiki(day))
+	assert.NotNil(t, err)
+	assert.Equal(t, int32(4), attempts.Load())
+	assert.Equal(t, 6.0, bucket.tokens)
+
+	//with tokens for only two attempts the retries wait on the limiter, here until the deadline
+	bucket.tokens = 2
+	fetcher, attempts, _ = stubPageviews(t, "", http.StatusServiceUnavailable)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = fetcher.Fetch(ctx, enwiki(day))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, int32(2), attempts.Load())
+}
+
+// Requests go to the configured base URL with the configured User-Agent, and slow attempts time out and are retried
+func Test_WikipediaFetcher_Config(t *testing.T) {
+	attempts := atomic.Int32{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/mirror/top/en.wikipedia/all-access/2021/01/01", r.URL.Path)
+		assert.Equal(t, "wikiapi-test/1.0 (test@example.com)", r.Header.Get("User-Agent"))
+		if attempts.Add(1) == 1 {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.Write([]byte(onePagePayload))
+	}))
+	defer server.Close()
+	fetcher := NewWikipediaFetcher(WikipediaFetcherConfig{
+		Client:    server.Client(),
+		BaseURL:   server.URL + "/mirror/",
+		UserAgent: "wikiapi-test/1.0 (test@example.com)",
+		Timeout:   50 * time.Millisecond,
+		Retry:     RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+	})
+	day, _ := time.Parse(constants.DATELAYOUT, "20210101")
+	counts, err := fetcher.Fetch(context.Background(), enwiki(day))
+	assert.Nil(t, err)
+	assert.Equal(t, 42, counts[0].Views)
+	assert.Equal(t, int32(2), attempts.Load())
+
+	//other projects and access methods go in the same place in the path
+	projectServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/top/de.wiktionary/mobile-web/2021/01/01", r.URL.Path)
+		w.Write([]byte(strings.Replace(onePagePayload, `"en.wikipedia","access":"all-access"`, `"de.wiktionary","access":"mobile-web"`, 1)))
+	}))
+	defer projectServer.Close()
+	fetcher = NewWikipediaFetcher(WikipediaFetcherConfig{BaseURL: projectServer.URL})
+	_, err = fetcher.Fetch(context.Background(), storage.NewKey("de.wiktionary", constants.ACCESS_MOBILE_WEB, day))
+	assert.Nil(t, err)
+
+	//defaults point at Wikimedia with our own User-Agent
+	defaults := NewWikipediaFetcher(WikipediaFetcherConfig{})
+	assert.Equal(t, constants.PAGEVIEWS_BASE_URL, defaults.config.BaseURL)
+	assert.Equal(t, constants.DEFAULT_USER_AGENT, defaults.config.UserAgent)
+	assert.Equal(t, DefaultRetryPolicy, defaults.config.Retry)
+}
+
+// The per-article endpoint is called once for the whole range and its items come back as dated counts
+func Test_WikipediaFetcher_FetchArticle(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.EscapedPath() == "/per-article/en.wikipedia/desktop/user/AC%2FDC/daily/20210101/20210102" {
+			w.Write([]byte(`{"items":[` +
+				`{"project":"en.wikipedia","article":"AC/DC","granularity":"daily","timestamp":"2021010100","access":"desktop","agent":"user","views":10},` +
+				`{"project":"en.wikipedia","article":"AC/DC","granularity":"daily","timestamp":"2021010200","access":"desktop","agent":"user","views":12}]}`))
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+	fetcher := NewWikipediaFetcher(WikipediaFetcherConfig{BaseURL: server.URL})
+	start, _ := time.Parse(constants.DATELAYOUT, "20210101")
+	end, _ := time.Parse(constants.DATELAYOUT, "20210102")
+	counts, err := fetcher.FetchArticle(context.Background(), constants.DEFAULT_PROJECT, constants.ACCESS_DESKTOP, "AC/DC", start, end)
+	assert.Nil(t, err)
+	assert.Equal(t, []messages.ArticleCount{{Name: "AC/DC", Views: 10, Date: start}, {Name: "AC/DC", Views: 12, Date: end}}, counts)
+
+	_, err = fetcher.FetchArticle(context.Background(), constants.DEFAULT_PROJECT, constants.ACCESS_DESKTOP, "No_such_article", start, end)
+	assert.ErrorIs(t, err, ErrNoData)
+	assert.Contains(t, err.Error(), "20210101-20210102 for en.wikipedia desktop article No_such_article")
+}
+
+// A 200 that doesn't answer the request is a malformed payload rather than no data, and never panics
+func Test_WikipediaFetcher_MalformedTopPayloads(t *testing.T) {
+	const item = `"project":"en.wikipedia","access":"all-access","year":"2021","month":"01","day":"01"`
+	tests := []struct {
+		name    string
+		body    string
+		wantErr string
+	}{
+		{name: "valid", body: `{"items":[{` + item + `,"articles":[{"article":"Main_Page","views":42,"rank":1}]}]}`},
+		{name: "valid empty day", body: `{"items":[{` + item + `,"articles":[]}]}`},
+		{name: "not json", body: `<html>Service Unavailable</html>`, wantErr: "malformed response: invalid character"},
+		{name: "truncated", body: onePagePayload[:40], wantErr: "malformed response: unexpected end of JSON input"},
+		{name: "no items key", body: `{}`, wantErr: "expected 1 item, got 0"},
+		{name: "empty items", body: `{"items":[]}`, wantErr: "expected 1 item, got 0"},
+		{name: "two items", body: `{"items":[{` + item + `,"articles":[]},{` + item + `,"articles":[]}]}`,
+			wantErr: "expected 1 item, got 2"},
+		{name: "other project", body: `{"items":[{"project":"de.wikipedia","access":"all-access","year":"2021","month":"01","day":"01","articles":[]}]}`,
+			wantErr: "item is for de.wikipedia all-access"},
+		{name: "other access", body: `{"items":[{"project":"en.wikipedia","access":"desktop","year":"2021","month":"01","day":"01","articles":[]}]}`,
+			wantErr: "item is for en.wikipedia desktop"},
+		{name: "other day", body: `{"items":[{"project":"en.wikipedia","access":"all-access","year":"2021","month":"01","day":"02","articles":[]}]}`,
+			wantErr: "item is for day 2021/01/02"},
+		{name: "no date", body: `{"items":[{"project":"en.wikipedia","access":"all-access","articles":[]}]}`,
+			wantErr: "item is for day //"},
+		{name: "negative views", body: `{"items":[{` + item + `,"articles":[{"article":"Main_Page","views":-1,"rank":1}]}]}`,
+			wantErr: "-1 views for Main_Page"},
+		{name: "unnamed article", body: `{"items":[{` + item + `,"articles":[{"views":1,"rank":1}]}]}`,
+			wantErr: "article without a name"},
+	}
+	day, _ := time.Parse(constants.DATELAYOUT, "20210101")
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(test.body))
+			}))
+			defer server.Close()
+			counts, err := NewWikipediaFetcher(WikipediaFetcherConfig{BaseURL: server.URL}).Fetch(context.Background(), enwiki(day))
+			if len(test.wantErr) == 0 {
+				assert.Nil(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, ErrMalformedPayload)
+			assert.NotErrorIs(t, err, ErrNoData)
+			assert.Contains(t, err.Error(), "20210101 for en.wikipedia all-access (malformed response")
+			assert.Contains(t, err.Error(), test.wantErr)
+			var fetchErr *FetchError
+			assert.ErrorAs(t, err, &fetchErr)
+			assert.Equal(t, http.StatusOK, fetchErr.StatusCode)
+			assert.Empty(t, counts)
+		})
+	}
+}
+
+// A title the top list repeats is merged into one count, the higher, instead of failing the day
+func Test_WikipediaFetcher_DuplicateTopArticles(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"items":[{"project":"en.wikipedia","access":"all-access","year":"2021","month":"01","day":"01","articles":[` +
+			`{"article":"A","views":2,"rank":1},{"article":"B","views":5,"rank":2},{"article":"A","views":9,"rank":3}]}]}`))
+	}))
+	defer server.Close()
+	day, _ := time.Parse(constants.DATELAYOUT, "20210101")
+	counts, err := NewWikipediaFetcher(WikipediaFetcherConfig{BaseURL: server.URL}).Fetch(context.Background(), enwiki(day))
+	assert.Nil(t, err)
+	assert.Equal(t, []messages.ArticleCount{{Name: "A", Views: 9}, {Name: "B", Views: 5}}, counts)
+}
+
+func Test_WikipediaFetcher_MalformedPerArticlePayloads(t *testing.T) {
+	entry := func(fields string) string {
+		return `{"project":"en.wikipedia","article":"Foo","granularity":"daily","access":"all-access","agent":"user",` + fields + `}`
+	}
+	tests := []struct {
+		name    string
+		body    string
+		want    int
+		wantErr string
+	}{
+		{name: "valid", body: `{"items":[` + entry(`"timestamp":"2021010100","views":1`) + `,` + entry(`"timestamp":"2021010200","views":0`) + `]}`,
+			want: 2},
+		{name: "no views in range", body: `{"items":[]}`},
+		{name: "not json", body: `{"items":`, wantErr: "unexpected end of JSON input"},
+		{name: "other article", body: `{"items":[{"project":"en.wikipedia","article":"Bar","granularity":"daily","access":"all-access","timestamp":"2021010100"}]}`,
+			wantErr: "item is for en.wikipedia all-access article Bar"},
+		{name: "monthly", body: `{"items":[{"project":"en.wikipedia","article":"Foo","granularity":"monthly","access":"all-access","timestamp":"2021010100"}]}`,
+			wantErr: "item has monthly granularity"},
+		{name: "bad timestamp", body: `{"items":[` + entry(`"timestamp":"20210101","views":1`) + `]}`, wantErr: `bad timestamp "20210101"`},
+		{name: "hourly timestamp", body: `{"items":[` + entry(`"timestamp":"2021010105","views":1`) + `]}`, wantErr: `bad timestamp "2021010105"`},
+		{name: "outside range", body: `{"items":[` + entry(`"timestamp":"2021010300","views":1`) + `]}`,
+			wantErr: "timestamp 2021010300 is outside the range asked for"},
+		{name: "duplicate day", body: `{"items":[` + entry(`"timestamp":"2021010100","views":1`) + `,` + entry(`"timestamp":"2021010100","views":1`) + `]}`,
+			wantErr: "timestamp 2021010100 listed twice"},
+		{name: "negative views", body: `{"items":[` + entry(`"timestamp":"2021010100","views":-5`) + `]}`, wantErr: "-5 views on 2021010100"},
+	}
+	start, _ := time.Parse(constants.DATELAYOUT, "20210101")
+	end, _ := time.Parse(constants.DATELAYOUT, "20210102")
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(test.body))
+			}))
+			defer server.Close()
+			fetcher := NewWikipediaFetcher(WikipediaFetcherConfig{BaseURL: server.URL})
+			counts, err := fetcher.FetchArticle(context.Background(), constants.DEFAULT_PROJECT, constants.DEFAULT_ACCESS, "Foo", start, end)
+			if len(test.wantErr) == 0 {
+				assert.Nil(t, err)
+				assert.Len(t, counts, test.want)
+				return
+			}
+			assert.ErrorIs(t, err, ErrMalformedPayload)
+			assert.Contains(t, err.Error(), "20210101-20210102 for en.wikipedia all-access article Foo (malformed response")
+			assert.Contains(t, err.Error(), test.wantErr)
+			assert.Empty(t, counts)
+		})
+	}
+}
+
+// A body cut short by the connection dropping is retried like any other transient failure
+func Test_WikipediaFetcher_TruncatedBody(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			//promise more than is sent, so the client sees an unexpected EOF
+			w.Header().Set("Content-Length", "1000")
+			w.Write([]byte(onePagePayload[:40]))
+			return
+		}
+		w.Write([]byte(onePagePayload))
+	}))
+	defer server.Close()
+	fetcher := NewWikipediaFetcher(WikipediaFetcherConfig{
+		BaseURL: server.URL,
+		Retry:   RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+	})
+	day, _ := time.Parse(constants.DATELAYOUT, "20210101")
+	counts, err := fetcher.Fetch(context.Background(), enwiki(day))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, attempts)
+	assert.Equal(t, 42, counts[0].Views)
+}
+
+// A done context stops a fetch mid-call and between retries, and is never retried itself
+func Test_WikipediaFetcher_Context(t *testing.T) {
+	attempts := atomic.Int32{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	fetcher := NewWikipediaFetcher(WikipediaFetcherConfig{
+		BaseURL: server.URL,
+		Timeout: time.Minute,
+		Retry:   RetryPolicy{MaxAttempts: 10, BaseDelay: time.Minute, MaxDelay: time.Minute},
+	})
+	day, _ := time.Parse(constants.DATELAYOUT, "20210101")
+
+	//the first attempt fails and the retry waits out its backoff, until the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	began := time.Now()
+	_, err := fetcher.Fetch(ctx, enwiki(day))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(began), time.Second)
+	assert.Equal(t, int32(1), attempts.Load())
+
+	//a call in progress is abandoned
+	fetcher.config.Retry.BaseDelay = time.Millisecond
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, err = fetcher.Fetch(ctx, enwiki(day))
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, int32(2), attempts.Load())
+}
+
+// Backoff grows exponentially but never past MaxDelay, with jitter keeping it between zero and the ceiling
+func Test_RetryPolicy_backoff(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 10, BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	for attempt := 1; attempt < 100; attempt++ {
+		ceiling := policy.MaxDelay
+		if attempt < 5 {
+			ceiling = policy.BaseDelay << (attempt - 1)
+		}
+		delay := policy.backoff(attempt)
+		assert.GreaterOrEqual(t, delay, time.Duration(0))
+		assert.LessOrEqual(t, delay, ceiling)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"io"
 	"net/http"
+	"os"
 	"strings"
 	"testing"
 	"time"
@@ -14,16 +15,22 @@ import (
 //1. During development by engineers as a smoke test
 //2. As part of a CD/CI pipeline with stubbed data
 //3. As a cronned health check against a live production instance
+//By default Wikipedia responses are replayed from the fixtures directory so it runs offline. Set
+//WIKIAPI_FETCH_MODE=live to run it against the real API instead
 
 func Test_E2E_API(t *testing.T) {
 	/*
 		Example code to show how Wikipedia fetcher can be stubbed out:
 		if (config.usestub){
-			indexer.Fetcher = func(date time.Time) ([]messages.ArticleCount, error) {
+			indexer.Fetcher = func(key storage.Key) ([]messages.ArticleCount, error) {
 				// returns stubbed data
 			}
 		}
 	*/
+	if len(os.Getenv(envFetchMode)) == 0 {
+		t.Setenv(envFetchMode, "replay")
+		t.Setenv(envFixturesDir, "../fixtures")
+	}
 	go main()
 	time.Sleep(4 * time.Second)
 	//mostviewed HappyPath
@@ -33,6 +40,31 @@ func Test_E2E_API(t *testing.T) {
 	payloadString := string(bytes[:])
 	assert.True(t, strings.Contains(payloadString, "\"Main_Page\",\"views\":10226718"))
 
+	//mostviewed first page
+	payloadString = get(t, "http://localhost:8080/mostviewed/20220101/20220102?limit=1")
+	assert.True(t, strings.Contains(payloadString, "\"articles\":[{\"name\":\"Main_Page\",\"views\":10226718,\"time\":\"0001-01-01T00:00:00Z\"}],\"total\":"))
+	assert.True(t, strings.Contains(payloadString, "\"next\":"))
+
+	//mostviewed articles only
+	payloadString = get(t, "http://localhost:8080/mostviewed/20220101/20220102?filter=articles&limit=5")
+	assert.True(t, strings.Contains(payloadString, "\"articles\":[{"))
+	assert.False(t, strings.Contains(payloadString, "Main_Page"))
+	assert.False(t, strings.Contains(payloadString, "Special:"))
+
+	//mostviewed bad filter params
+	payloadString = get(t, "http://localhost:8080/mostviewed/20220101/20220102?exclude=(")
+	assert.True(t, strings.Contains(payloadString, "Bad exclude value: error parsing regexp"))
+	payloadString = get(t, "http://localhost:8080/mostviewed/20220101/20220102?filter=pages")
+	assert.True(t, strings.Contains(payloadString, "Bad filter value: pages"))
+	payloadString = get(t, "http://localhost:8080/ja.wikipedia/mostviewed/20220101/20220102?filter=articles")
+	assert.True(t, strings.Contains(payloadString, "articles is not supported for ja.wikipedia"))
+
+	//mostviewed bad page params
+	payloadString = get(t, "http://localhost:8080/mostviewed/20220101/20220102?limit=0")
+	assert.True(t, strings.Contains(payloadString, "Bad limit value: 0"))
+	payloadString = get(t, "http://localhost:8080/mostviewed/20220101/20220102?limit=1&offset=1&cursor=abc")
+	assert.True(t, strings.Contains(payloadString, "cursor and offset cannot be used together"))
+
 	//mostviewed bad dates
 	r, _ = http.Get("http://localhost:8080/mostviewed/20220101/")
 	defer r.Body.Close()
@@ -48,6 +80,26 @@ func Test_E2E_API(t *testing.T) {
 	assert.True(t, strings.Contains(payloadString, "Unable to retrieve page count data from Wikipedia: 20010101"))
 	assert.True(t, strings.Contains(payloadString, "Unable to retrieve page count data from Wikipedia: 20010102"))
 
+	//replayed runs only answer from the fixtures, so a day that wasn't recorded fails rather than calling Wikipedia
+	if os.Getenv(envFetchMode) == "replay" {
+		payloadString = get(t, "http://localhost:8080/mostviewed/20230101/20230101")
+		assert.True(t, strings.Contains(payloadString, "no recorded response for"))
+		assert.True(t, strings.Contains(payloadString, "/top/en.wikipedia/all-access/2023/01/01"))
+	}
+
+	//mostviewed partial results still fail when no day can be read
+	payloadString = get(t, "http://localhost:8080/mostviewed/20010101/20010102?partial=true")
+	assert.True(t, strings.Contains(payloadString, "Unable to retrieve page count data from Wikipedia: 20010101"))
+
+	//mostviewed partial results with every day read are complete
+	payloadString = get(t, "http://localhost:8080/mostviewed/20220101/20220102?partial=true")
+	assert.True(t, strings.Contains(payloadString, "\"Main_Page\",\"views\":10226718"))
+	assert.False(t, strings.Contains(payloadString, "incomplete"))
+
+	//mostviewed bad partial value
+	payloadString = get(t, "http://localhost:8080/mostviewed/20220101/20220102?partial=maybe")
+	assert.True(t, strings.Contains(payloadString, "Bad partial value: maybe"))
+
 	//mostviewed more than maximum duration
 	r, _ = http.Get("http://localhost:8080/mostviewed/20210101/20220101")
 	defer r.Body.Close()
@@ -106,6 +158,20 @@ func Test_E2E_API(t *testing.T) {
 	payloadString = string(bytes[:])
 	assert.True(t, strings.Contains(payloadString, "{\"startdate\":\"2021-01-01T00:00:00Z\",\"enddate\":\"2021-01-03T00:00:00Z\",\"articles\":null}"))
 
+	//admin endpoints are refused without WIKIAPI_ADMIN_TOKEN set
+	if len(os.Getenv(envAdminToken)) == 0 {
+		r, err := http.Post("http://localhost:8080/admin/snapshot", "application/gzip", strings.NewReader(""))
+		if assert.Nil(t, err) {
+			r.Body.Close()
+			assert.Equal(t, http.StatusForbidden, r.StatusCode)
+		}
+		r, err = http.Get("http://localhost:8080/admin/snapshot")
+		if assert.Nil(t, err) {
+			r.Body.Close()
+			assert.Equal(t, http.StatusForbidden, r.StatusCode)
+		}
+	}
+
 	//Test viewcount - missing article param
 	r, _ = http.Get("http://localhost:8080/viewcount/20210101/20210103")
 	defer r.Body.Close()
@@ -114,3 +180,15 @@ func Test_E2E_API(t *testing.T) {
 	assert.True(t, strings.Contains(payloadString, "404 page not found"))
 
 }
+
+// get fetches a url and returns the body, failing the test if the call can't be made
+func get(t *testing.T, url string) string {
+	r, err := http.Get(url)
+	if !assert.Nil(t, err) {
+		return ""
+	}
+	defer r.Body.Close()
+	bytes, err := io.ReadAll(r.Body)
+	assert.Nil(t, err)
+	return string(bytes[:])
+}
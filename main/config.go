@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"pelotechfun/constants"
+	"pelotechfun/indexer"
+	"pelotechfun/storage"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Environment variables read at startup. Everything is optional and defaults to the original in-memory behaviour
+const (
+	envStorage           = "WIKIAPI_STORAGE"
+	envStorageDir        = "WIKIAPI_STORAGE_DIR"
+	envCacheMaxDays      = "WIKIAPI_CACHE_MAX_DAYS"
+	envCacheMaxBytes     = "WIKIAPI_CACHE_MAX_BYTES"
+	envCacheTTL          = "WIKIAPI_CACHE_TTL"
+	envCacheRecentTTL    = "WIKIAPI_CACHE_RECENT_TTL"
+	envCacheRecentWindow = "WIKIAPI_CACHE_RECENT_WINDOW"
+	envRedisAddr         = "WIKIAPI_REDIS_ADDR"
+	envRedisPassword     = "WIKIAPI_REDIS_PASSWORD"
+	envRedisDB           = "WIKIAPI_REDIS_DB"
+	envRedisKeyPrefix    = "WIKIAPI_REDIS_KEY_PREFIX"
+	envAdminToken        = "WIKIAPI_ADMIN_TOKEN"
+	envFetchConcurrency  = "WIKIAPI_FETCH_CONCURRENCY"
+	envRetryMaxAttempts  = "WIKIAPI_RETRY_MAX_ATTEMPTS"
+	envRetryBaseDelay    = "WIKIAPI_RETRY_BASE_DELAY"
+	envRetryMaxDelay     = "WIKIAPI_RETRY_MAX_DELAY"
+	envPageviewsURL      = "WIKIAPI_PAGEVIEWS_URL"
+	envUserAgent         = "WIKIAPI_USER_AGENT"
+	envFetchTimeout      = "WIKIAPI_FETCH_TIMEOUT"
+	envFetchRate         = "WIKIAPI_FETCH_RATE"
+	envFetchBurst        = "WIKIAPI_FETCH_BURST"
+	envMaxDayInterval    = "WIKIAPI_MAX_DAY_INTERVAL"
+	envBreakerWindow     = "WIKIAPI_BREAKER_WINDOW"
+	envBreakerMinCalls   = "WIKIAPI_BREAKER_MIN_REQUESTS"
+	envBreakerErrorRate  = "WIKIAPI_BREAKER_ERROR_RATE"
+	envBreakerOpenFor    = "WIKIAPI_BREAKER_OPEN_DURATION"
+	envFetchMode         = "WIKIAPI_FETCH_MODE"
+	envFixturesDir       = "WIKIAPI_FIXTURES_DIR"
+	envRequestTimeout    = "WIKIAPI_REQUEST_TIMEOUT"
+)
+
+// config holds the startup settings for the app
+type config struct {
+	storage    string
+	storageDir string
+	cache      storage.BoundedStorageOptions
+	redis      storage.RedisOptions
+	adminToken string
+	// fetchConcurrency caps simultaneous calls to Wikipedia across all requests
+	fetchConcurrency int
+	fetcher          indexer.WikipediaFetcherConfig
+	// fetchRate and fetchBurst configure the outbound rate limit in calls/second
+	fetchRate      float64
+	fetchBurst     int
+	maxDayInterval int
+	breaker        indexer.BreakerSettings
+	// requestTimeout bounds how long an article query may run before it is abandoned with a 504. Zero means no limit
+	requestTimeout time.Duration
+}
+
+// loadConfig reads the app config from the environment, applying defaults for anything unset
+func loadConfig() (config, error) {
+	cfg := config{
+		storage:    getenv(envStorage, "memory"),
+		storageDir: getenv(envStorageDir, "data"),
+		adminToken: getenv(envAdminToken, ""),
+		redis: storage.RedisOptions{
+			Addr:      getenv(envRedisAddr, "localhost:6379"),
+			Password:  getenv(envRedisPassword, ""),
+			KeyPrefix: getenv(envRedisKeyPrefix, ""),
+		},
+	}
+	var err error
+	if cfg.redis.DB, err = getenvInt(envRedisDB, 0); err != nil {
+		return cfg, err
+	}
+	if cfg.fetchConcurrency, err = getenvInt(envFetchConcurrency, constants.DEFAULT_FETCH_CONCURRENCY); err != nil {
+		return cfg, err
+	}
+	if cfg.fetchRate, err = getenvFloat(envFetchRate, constants.DEFAULT_FETCH_RATE); err != nil {
+		return cfg, err
+	}
+	if cfg.fetchBurst, err = getenvInt(envFetchBurst, constants.DEFAULT_FETCH_BURST); err != nil {
+		return cfg, err
+	}
+	if cfg.maxDayInterval, err = getenvInt(envMaxDayInterval, constants.MAXDAYINTERVAL); err != nil {
+		return cfg, err
+	}
+	if cfg.requestTimeout, err = getenvDuration(envRequestTimeout, 0); err != nil {
+		return cfg, err
+	}
+	cfg.breaker = indexer.DefaultBreakerSettings
+	if cfg.breaker.Window, err = getenvDuration(envBreakerWindow, cfg.breaker.Window); err != nil {
+		return cfg, err
+	}
+	if cfg.breaker.MinRequests, err = getenvInt(envBreakerMinCalls, cfg.breaker.MinRequests); err != nil {
+		return cfg, err
+	}
+	if cfg.breaker.ErrorRate, err = getenvFloat(envBreakerErrorRate, cfg.breaker.ErrorRate); err != nil {
+		return cfg, err
+	}
+	if cfg.breaker.OpenDuration, err = getenvDuration(envBreakerOpenFor, cfg.breaker.OpenDuration); err != nil {
+		return cfg, err
+	}
+	cfg.fetcher.BaseURL = getenv(envPageviewsURL, constants.PAGEVIEWS_BASE_URL)
+	cfg.fetcher.UserAgent = getenv(envUserAgent, constants.DEFAULT_USER_AGENT)
+	if cfg.fetcher.Client, err = newFetchClient(getenv(envFetchMode, "live"), getenv(envFixturesDir, "fixtures"), cfg.fetcher.BaseURL); err != nil {
+		return cfg, err
+	}
+	if cfg.fetcher.Timeout, err = getenvDuration(envFetchTimeout, 30*time.Second); err != nil {
+		return cfg, err
+	}
+	retry := &cfg.fetcher.Retry
+	if retry.MaxAttempts, err = getenvInt(envRetryMaxAttempts, indexer.DefaultRetryPolicy.MaxAttempts); err != nil {
+		return cfg, err
+	}
+	if retry.BaseDelay, err = getenvDuration(envRetryBaseDelay, indexer.DefaultRetryPolicy.BaseDelay); err != nil {
+		return cfg, err
+	}
+	if retry.MaxDelay, err = getenvDuration(envRetryMaxDelay, indexer.DefaultRetryPolicy.MaxDelay); err != nil {
+		return cfg, err
+	}
+	if cfg.cache.MaxDays, err = getenvInt(envCacheMaxDays, 0); err != nil {
+		return cfg, err
+	}
+	maxBytes, err := getenvInt(envCacheMaxBytes, 0)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.cache.MaxBytes = int64(maxBytes)
+	if cfg.cache.TTL, err = getenvDuration(envCacheTTL, 0); err != nil {
+		return cfg, err
+	}
+	if cfg.cache.RecentTTL, err = getenvDuration(envCacheRecentTTL, 0); err != nil {
+		return cfg, err
+	}
+	if cfg.cache.RecentWindow, err = getenvDuration(envCacheRecentWindow, 72*time.Hour); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// newFetchClient builds the HTTP client used to call Wikipedia. In record mode every response is also saved to the
+// fixtures directory, and in replay mode responses are only served from there so the app runs offline
+func newFetchClient(mode string, fixturesDir string, baseURL string) (*http.Client, error) {
+	switch mode {
+	case "live":
+		return http.DefaultClient, nil
+	case "record":
+		return &http.Client{Transport: indexer.NewRecordingTransport(fixturesDir, baseURL, nil)}, nil
+	case "replay":
+		return &http.Client{Transport: indexer.NewReplayTransport(fixturesDir, baseURL)}, nil
+	default:
+		return nil, fmt.Errorf("unknown %s: %q (expected live, record or replay)", envFetchMode, mode)
+	}
+}
+
+// newStorage builds the storage implementation selected by the config. A comma separated list of backends, fastest
+// first, is composed into a tiered store, e.g. "bounded,redis"
+func newStorage(cfg config) (storage.ContextStorage, error) {
+	names := strings.Split(cfg.storage, ",")
+	if len(names) == 1 {
+		return newBackend(cfg, names[0])
+	}
+	tiers := make([]storage.Tier, len(names))
+	for i, name := range names {
+		name = strings.TrimSpace(name)
+		backend, err := newBackend(cfg, name)
+		if err != nil {
+			return nil, err
+		}
+		tiers[i] = storage.Tier{Name: name, Storage: backend}
+	}
+	return storage.NewTieredStorage(tiers...), nil
+}
+
+// newBackend builds a single named storage backend
+func newBackend(cfg config, name string) (storage.ContextStorage, error) {
+	switch name {
+	case "memory":
+		return storage.Adapt(storage.NewLocalMapStorage()), nil
+	case "bounded":
+		return storage.Adapt(storage.NewBoundedStorage(cfg.cache)), nil
+	case "file":
+		return storage.NewFileStorage(cfg.storageDir)
+	case "redis":
+		return storage.NewRedisStorage(context.Background(), cfg.redis)
+	default:
+		return nil, fmt.Errorf("unknown %s backend: %q (expected memory, bounded, file or redis)", envStorage, name)
+	}
+}
+
+func getenv(key string, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok && len(value) > 0 {
+		return value
+	}
+	return fallback
+}
+
+func getenvInt(key string, fallback int) (int, error) {
+	value := getenv(key, "")
+	if len(value) == 0 {
+		return fallback, nil
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return fallback, fmt.Errorf("bad %s value: %w", key, err)
+	}
+	return parsed, nil
+}
+
+func getenvFloat(key string, fallback float64) (float64, error) {
+	value := getenv(key, "")
+	if len(value) == 0 {
+		return fallback, nil
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return fallback, fmt.Errorf("bad %s value: %w", key, err)
+	}
+	return parsed, nil
+}
+
+func getenvDuration(key string, fallback time.Duration) (time.Duration, error) {
+	value := getenv(key, "")
+	if len(value) == 0 {
+		return fallback, nil
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return fallback, fmt.Errorf("bad %s value: %w", key, err)
+	}
+	return parsed, nil
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/go-chi/chi/v5/middleware"
 	log "github.com/sirupsen/logrus"
 	"net/http"
+	"pelotechfun/indexer"
 	"pelotechfun/service"
 )
 
@@ -21,11 +22,46 @@ func main() {
 		err = errors.Join(err, otelShutdown(context.Background()))
 	}()
 	log.SetLevel(log.InfoLevel)
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	db, err := newStorage(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	indexer.DB = db
+	indexer.SetFetchConcurrency(cfg.fetchConcurrency)
+	wikipedia := indexer.NewWikipediaFetcher(cfg.fetcher)
+	indexer.Fetcher = wikipedia.Fetch
+	indexer.ArticleFetcher = wikipedia.FetchArticle
+	indexer.SetFetchRateLimit(cfg.fetchRate, cfg.fetchBurst)
+	service.MaxDayInterval = cfg.maxDayInterval
+	indexer.Breaker = indexer.NewCircuitBreaker(cfg.breaker)
 	r := chi.NewRouter()
 	r.Use(middleware.Logger)
-	r.Get("/mostviewed/{startdate}/{enddate}", service.DoGetArticleCountsForDateRange)
-	r.Get("/viewcount/{article}/{startdate}/{enddate}", service.DoCalcViewCountForArticle)
-	r.Get("/mostviewedday/{article}/{year}/{month}", service.DoCalcMostViewedDayInMonthForArticle)
+	//article routes are served for en.wikipedia at the root and for any other wiki under its project name,
+	//e.g. /de.wikipedia/mostviewed/20220101/20220102
+	articleRoutes := func(r chi.Router) {
+		r.Get("/mostviewed/{startdate}/{enddate}", service.DoGetArticleCountsForDateRange)
+		r.Get("/viewcount/{article}/{startdate}/{enddate}", service.DoCalcViewCountForArticle)
+		r.Get("/mostviewedday/{article}/{year}/{month}", service.DoCalcMostViewedDayInMonthForArticle)
+		r.Get("/timeseries/{article}/{startdate}/{enddate}", service.DoGetTimeSeriesForArticle)
+	}
+	r.Group(func(r chi.Router) {
+		r.Use(service.Deadline(cfg.requestTimeout))
+		articleRoutes(r)
+		r.Route("/{project}", articleRoutes)
+	})
+	r.Get("/status/circuitbreaker", service.DoGetCircuitBreakerStatus)
+	if len(cfg.adminToken) == 0 {
+		log.Warnf("%s is not set, admin endpoints are disabled", envAdminToken)
+	}
+	r.Route("/admin", func(r chi.Router) {
+		r.Use(service.RequireToken(cfg.adminToken))
+		r.Get("/snapshot", service.DoExportSnapshot)
+		r.Post("/snapshot", service.DoImportSnapshot)
+	})
 	log.Infof("Hi! listening on localhost:8080")
 	log.Fatal(http.ListenAndServe(":8080", r))
 }
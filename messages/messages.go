@@ -2,18 +2,38 @@ package messages
 
 import "time"
 
-// Type ArticleCount captures the counts for an article
+// Type ArticleCount captures the counts for an article. Missing marks an entry of a time series for a day there is
+// no data for, as opposed to a day with zero views
 type ArticleCount struct {
-	Name  string    `json:"name"`
-	Views int       `json:"views"`
-	Date  time.Time `json:"time"`
+	Name    string    `json:"name"`
+	Views   int       `json:"views"`
+	Date    time.Time `json:"time"`
+	Missing bool      `json:"missing,omitempty"`
 }
 
-// Type ArticleCountsForDateRange wrappers a set of article counts aggregated for the days between StartDate and EndDate (inclusive of both)
+// Type ArticleCountsForDateRange wrappers a set of article counts aggregated for the days between StartDate and EndDate (inclusive of both).
+// Total is the number of articles in a ranking over all its pages, and Next the cursor of the page after this one.
+// Incomplete marks a partial result that leaves out the MissingDays that couldn't be retrieved
 type ArticleCountsForDateRange struct {
 	StartDate     time.Time      ` json:"startdate"`
 	EndDate       time.Time      `json:"enddate"`
 	ArticleCounts []ArticleCount `json:"articles"`
+	Total         int            `json:"total,omitempty"`
+	Next          string         `json:"next,omitempty"`
+	Incomplete    bool           `json:"incomplete,omitempty"`
+	MissingDays   []time.Time    `json:"missingdays,omitempty"`
+}
+
+// Type ArticleCountsByAccess holds the article counts for a date range broken down by access method (desktop,
+// mobile-app, mobile-web), side by side. Totals are the number of articles in each method's ranking over all its pages.
+// MissingDays are the days left out of any of the methods' partial results
+type ArticleCountsByAccess struct {
+	StartDate   time.Time                 `json:"startdate"`
+	EndDate     time.Time                 `json:"enddate"`
+	Access      map[string][]ArticleCount `json:"access"`
+	Totals      map[string]int            `json:"totals,omitempty"`
+	Incomplete  bool                      `json:"incomplete,omitempty"`
+	MissingDays []time.Time               `json:"missingdays,omitempty"`
 }
 
 // Type WPPageViewsPayload models the response payload of the Wikipedia Pageviews API
@@ -31,3 +51,16 @@ type WPPageViewsPayload struct {
 		} `json:"articles"`
 	} `json:"items"`
 }
+
+// Type WPPerArticlePayload models the response payload of the Wikipedia Pageviews API per-article endpoint
+type WPPerArticlePayload struct {
+	Items []struct {
+		Project     string `json:"project"`
+		Article     string `json:"article"`
+		Granularity string `json:"granularity"`
+		Timestamp   string `json:"timestamp"`
+		Access      string `json:"access"`
+		Agent       string `json:"agent"`
+		Views       int    `json:"views"`
+	} `json:"items"`
+}
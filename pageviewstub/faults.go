@@ -0,0 +1,93 @@
+package pageviewstub
+
+import (
+	"fmt"
+	"net/http"
+	"pelotechfun/constants"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Type Fault makes the stub misbehave for one day. Status (429, 5xx, 404...) is returned instead of data, and Latency
+// delays the response on top of Options.Latency. Times limits a Status fault to the first Times requests for each URL
+// covering the day, so retries can be seen to succeed; zero fails every request
+type Fault struct {
+	Day     time.Time
+	Status  int
+	Latency time.Duration
+	Times   int
+}
+
+// Function ParseFaults reads faults from a comma separated list of DAY=EFFECT entries, where DAY is YYYYMMDD and EFFECT
+// is a status code ("404"), a status code failing only the first N requests ("503*2") or a delay ("2s"), e.g.
+// "20210101=404,20210102=503*2,20210103=429,20210104=1500ms". Repeat a day to combine effects
+func ParseFaults(spec string) ([]Fault, error) {
+	faults := []Fault{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+		dayText, effect, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("fault %q: expected DAY=EFFECT", entry)
+		}
+		day, err := time.Parse(constants.DATELAYOUT, dayText)
+		if err != nil {
+			return nil, fmt.Errorf("fault %q: bad day: %w", entry, err)
+		}
+		fault := Fault{Day: day}
+		if latency, err := time.ParseDuration(effect); err == nil {
+			if latency < 0 {
+				return nil, fmt.Errorf("fault %q: negative delay", entry)
+			}
+			fault.Latency = latency
+			faults = append(faults, fault)
+			continue
+		}
+		statusText, timesText, limited := strings.Cut(effect, "*")
+		if fault.Status, err = strconv.Atoi(statusText); err != nil || fault.Status < 400 || fault.Status > 599 {
+			return nil, fmt.Errorf("fault %q: expected a 4xx or 5xx status code or a delay", entry)
+		}
+		if limited {
+			if fault.Times, err = strconv.Atoi(timesText); err != nil || fault.Times < 1 {
+				return nil, fmt.Errorf("fault %q: bad request count %q", entry, timesText)
+			}
+		}
+		faults = append(faults, fault)
+	}
+	return faults, nil
+}
+
+// String formats f the way ParseFaults reads it
+func (f Fault) String() string {
+	day := f.Day.Format(constants.DATELAYOUT)
+	switch {
+	case f.Status == 0:
+		return day + "=" + f.Latency.String()
+	case f.Times > 0:
+		return fmt.Sprintf("%s=%d*%d", day, f.Status, f.Times)
+	default:
+		return fmt.Sprintf("%s=%d", day, f.Status)
+	}
+}
+
+// problem is the error body the Pageviews API returns, in the HyperSwitch problem format
+type problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Method string `json:"method"`
+	Detail string `json:"detail"`
+	URI    string `json:"uri"`
+}
+
+func newProblem(r *http.Request, status int, detail string) problem {
+	return problem{
+		Type:   "https://mediawiki.org/wiki/HyperSwitch/errors/" + strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_"),
+		Title:  http.StatusText(status),
+		Method: strings.ToLower(r.Method),
+		Detail: detail,
+		URI:    r.URL.RequestURI(),
+	}
+}
@@ -0,0 +1,313 @@
+// Package pageviewstub is a stand-in for the Wikimedia Pageviews REST API, for load tests and for running the app
+// without Wikipedia. It serves the top and per-article routes in the API's own JSON shape, with synthetic counts that
+// depend only on a seed, and can be told to fail or slow down on chosen days. Point the real fetcher at it with
+// WIKIAPI_PAGEVIEWS_URL, or run it with cmd/pageviewstub
+package pageviewstub
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"net/url"
+	"pelotechfun/constants"
+	"pelotechfun/messages"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// number of articles in each top list by default, matching the Pageviews API
+const DEFAULT_ARTICLES = 1000
+
+// Type Options tunes a Server
+type Options struct {
+	// Seed picks the synthetic data set. The same seed always serves the same counts
+	Seed int64
+	// Articles is the length of each top list. Defaults to DEFAULT_ARTICLES
+	Articles int
+	// Latency delays every response
+	Latency time.Duration
+	// Faults make chosen days fail or slow down
+	Faults []Fault
+}
+
+// Type Server is an http.Handler serving the Pageviews API routes the app uses:
+//
+//	/top/{project}/{access}/{year}/{month}/{day}
+//	/per-article/{project}/{access}/user/{article}/daily/{start}/{end}
+//
+// Any project is served. Each article has a fixed popularity (a Zipf curve over the top list articles; low and hashed
+// from the name for any other article) varied per day by the seed. Counts are consistent between routes, and
+// all-access is the sum of desktop, mobile-app and mobile-web, so the app's cross checks hold
+type Server struct {
+	options Options
+	router  chi.Router
+	// names are the articles top lists are drawn from, twice as many as fit so lists change from day to day
+	names []string
+	ranks map[string]int
+	// mutex guards served, the number of requests seen per fault and URL for Fault.Times
+	mutex  sync.Mutex
+	served map[string]int
+}
+
+// Function New creates a Server
+func New(options Options) *Server {
+	if options.Articles <= 0 {
+		options.Articles = DEFAULT_ARTICLES
+	}
+	names := make([]string, 2*options.Articles)
+	ranks := make(map[string]int, len(names))
+	for i := range names {
+		switch i {
+		case 0:
+			names[i] = "Main_Page"
+		case 1:
+			names[i] = "Special:Search"
+		default:
+			names[i] = fmt.Sprintf("Article_%05d", i)
+		}
+		ranks[names[i]] = i + 1
+	}
+	s := &Server{options: options, names: names, ranks: ranks, served: make(map[string]int)}
+	router := chi.NewRouter()
+	router.Get("/top/{project}/{access}/{year}/{month}/{day}", s.top)
+	router.Get("/per-article/{project}/{access}/{agent}/{article}/{granularity}/{start}/{end}", s.perArticle)
+	router.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusNotFound, newProblem(r, http.StatusNotFound, "Not a Pageviews API route"))
+	})
+	s.router = router
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.router.ServeHTTP(w, r)
+}
+
+func (s *Server) top(w http.ResponseWriter, r *http.Request) {
+	project, access, ok := s.projectAndAccess(w, r)
+	if !ok {
+		return
+	}
+	day, err := time.Parse("2006/01/02", chi.URLParam(r, "year")+"/"+chi.URLParam(r, "month")+"/"+chi.URLParam(r, "day"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, newProblem(r, http.StatusBadRequest, "Invalid date"))
+		return
+	}
+	if !s.misbehave(w, r, day, day) {
+		return
+	}
+
+	payload := messages.WPPageViewsPayload{}
+	payload.Items = make([]struct {
+		Project  string `json:"project"`
+		Access   string `json:"access"`
+		Year     string `json:"year"`
+		Month    string `json:"month"`
+		Day      string `json:"day"`
+		Articles []struct {
+			Article string `json:"article"`
+			Views   int    `json:"views"`
+			Rank    int    `json:"rank"`
+		} `json:"articles"`
+	}, 1)
+	item := &payload.Items[0]
+	item.Project, item.Access = project, access
+	item.Year, item.Month, item.Day = day.Format("2006"), day.Format("01"), day.Format("02")
+	counts := s.TopList(project, access, day)
+	item.Articles = make([]struct {
+		Article string `json:"article"`
+		Views   int    `json:"views"`
+		Rank    int    `json:"rank"`
+	}, len(counts))
+	for i, count := range counts {
+		item.Articles[i].Article, item.Articles[i].Views, item.Articles[i].Rank = count.Name, count.Views, i+1
+	}
+	writeJSON(w, http.StatusOK, payload)
+}
+
+func (s *Server) perArticle(w http.ResponseWriter, r *http.Request) {
+	project, access, ok := s.projectAndAccess(w, r)
+	if !ok {
+		return
+	}
+	if chi.URLParam(r, "agent") != "user" || chi.URLParam(r, "granularity") != "daily" {
+		writeJSON(w, http.StatusBadRequest, newProblem(r, http.StatusBadRequest, "The stub only serves the user agent at daily granularity"))
+		return
+	}
+	article, err := url.PathUnescape(chi.URLParam(r, "article"))
+	start, startErr := parseTimestamp(chi.URLParam(r, "start"))
+	end, endErr := parseTimestamp(chi.URLParam(r, "end"))
+	if err != nil || startErr != nil || endErr != nil || end.Before(start) {
+		writeJSON(w, http.StatusBadRequest, newProblem(r, http.StatusBadRequest, "Invalid article or dates"))
+		return
+	}
+	if !s.misbehave(w, r, start, end) {
+		return
+	}
+
+	payload := messages.WPPerArticlePayload{}
+	days := int(end.Sub(start).Hours()/24) + 1
+	payload.Items = make([]struct {
+		Project     string `json:"project"`
+		Article     string `json:"article"`
+		Granularity string `json:"granularity"`
+		Timestamp   string `json:"timestamp"`
+		Access      string `json:"access"`
+		Agent       string `json:"agent"`
+		Views       int    `json:"views"`
+	}, days)
+	for i := range payload.Items {
+		day := start.AddDate(0, 0, i)
+		item := &payload.Items[i]
+		item.Project, item.Article, item.Granularity, item.Access, item.Agent = project, article, "daily", access, "user"
+		item.Timestamp = day.Format(constants.DATELAYOUT) + "00"
+		item.Views = s.Views(project, access, article, day)
+	}
+	writeJSON(w, http.StatusOK, payload)
+}
+
+// projectAndAccess reads the project and access method of a request, writing a 400 for an unknown access method
+func (s *Server) projectAndAccess(w http.ResponseWriter, r *http.Request) (string, string, bool) {
+	project, projectErr := url.PathUnescape(chi.URLParam(r, "project"))
+	access := chi.URLParam(r, "access")
+	switch access {
+	case constants.ACCESS_ALL, constants.ACCESS_DESKTOP, constants.ACCESS_MOBILE_APP, constants.ACCESS_MOBILE_WEB:
+	default:
+		projectErr = fmt.Errorf("unknown access method %q", access)
+	}
+	if projectErr != nil {
+		writeJSON(w, http.StatusBadRequest, newProblem(r, http.StatusBadRequest, projectErr.Error()))
+		return "", "", false
+	}
+	return project, access, true
+}
+
+// misbehave applies Options.Latency and any faults for the days between start and end (inclusive). Returns false if a
+// fault response was written in place of the data
+func (s *Server) misbehave(w http.ResponseWriter, r *http.Request, start time.Time, end time.Time) bool {
+	delay := s.options.Latency
+	status := 0
+	for i, fault := range s.options.Faults {
+		if fault.Day.Before(start) || fault.Day.After(end) {
+			continue
+		}
+		delay += fault.Latency
+		if fault.Status != 0 && status == 0 && s.firstServed(i, r.URL.Path, fault.Times) {
+			status = fault.Status
+		}
+	}
+	if !pause(r.Context(), delay) {
+		return false
+	}
+	if status == 0 {
+		return true
+	}
+	detail := "Injected fault"
+	if status == http.StatusNotFound {
+		detail = "The date(s) you used are valid, but we either do not have data for those date(s), or the project you asked for is not loaded yet."
+	}
+	writeJSON(w, status, newProblem(r, status, detail))
+	return false
+}
+
+// firstServed counts a request for path against fault i, reporting whether it is within the first times requests.
+// Zero times means every request
+func (s *Server) firstServed(i int, path string, times int) bool {
+	if times == 0 {
+		return true
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	key := strconv.Itoa(i) + " " + path
+	s.served[key]++
+	return s.served[key] <= times
+}
+
+// TopList returns the articles the top route serves for a project, access method and day, most viewed first
+func (s *Server) TopList(project string, access string, day time.Time) []messages.ArticleCount {
+	counts := make([]messages.ArticleCount, len(s.names))
+	for i, name := range s.names {
+		counts[i] = messages.ArticleCount{Name: name, Views: s.Views(project, access, name, day), Date: day}
+	}
+	slices.SortFunc(counts, func(a, b messages.ArticleCount) int {
+		if a.Views != b.Views {
+			return cmp.Compare(b.Views, a.Views)
+		}
+		return cmp.Compare(a.Name, b.Name)
+	})
+	return counts[:s.options.Articles]
+}
+
+// Views returns the views the stub serves for an article on a day
+func (s *Server) Views(project string, access string, article string, day time.Time) int {
+	base := 1 + int(1000*s.unit(article))
+	if rank, ok := s.ranks[article]; ok {
+		base = 5000000 / rank
+	}
+	date := day.Format(constants.DATELAYOUT)
+	total := int(float64(base) * (0.5 + s.unit(project, article, date)))
+	desktop := int(float64(total) * (0.25 + 0.3*s.unit(article, constants.ACCESS_DESKTOP)))
+	app := int(float64(total) * (0.02 + 0.08*s.unit(article, constants.ACCESS_MOBILE_APP)))
+	switch access {
+	case constants.ACCESS_DESKTOP:
+		return desktop
+	case constants.ACCESS_MOBILE_APP:
+		return app
+	case constants.ACCESS_MOBILE_WEB:
+		return total - desktop - app
+	default:
+		return total
+	}
+}
+
+// unit hashes the seed and parts to a number in [0, 1)
+func (s *Server) unit(parts ...string) float64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(strconv.FormatInt(s.options.Seed, 10)))
+	for _, part := range parts {
+		hash.Write([]byte{0})
+		hash.Write([]byte(part))
+	}
+	//FNV barely changes its high bits when only the last byte differs, so mix them (the splitmix64 finalizer)
+	sum := hash.Sum64()
+	sum = (sum ^ (sum >> 30)) * 0xbf58476d1ce4e5b9
+	sum = (sum ^ (sum >> 27)) * 0x94d049bb133111eb
+	sum ^= sum >> 31
+	return float64(sum>>11) / math.Exp2(53)
+}
+
+// parseTimestamp reads a per-article route date, given as YYYYMMDD or YYYYMMDDHH like the API accepts
+func parseTimestamp(timestamp string) (time.Time, error) {
+	if len(timestamp) == len(constants.DATELAYOUT)+2 {
+		timestamp = timestamp[:len(constants.DATELAYOUT)]
+	}
+	return time.Parse(constants.DATELAYOUT, timestamp)
+}
+
+// pause waits for d, returning false if the request is cancelled first
+func pause(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	bytes, _ := json.Marshal(body)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(bytes)
+}
@@ -0,0 +1,123 @@
+package pageviewstub
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"pelotechfun/constants"
+	"pelotechfun/indexer"
+	"pelotechfun/storage"
+	"testing"
+	"time"
+)
+
+func day(text string) time.Time {
+	d, _ := time.Parse(constants.DATELAYOUT, text)
+	return d
+}
+
+// fetcherFor starts s and returns the app's real fetcher pointed at it, retrying quickly
+func fetcherFor(t *testing.T, s *Server) *indexer.WikipediaFetcher {
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+	return indexer.NewWikipediaFetcher(indexer.WikipediaFetcherConfig{
+		BaseURL: server.URL,
+		Retry:   indexer.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond},
+	})
+}
+
+func Test_Server_Deterministic(t *testing.T) {
+	jan1 := storage.NewKey(constants.DEFAULT_PROJECT, constants.ACCESS_ALL, day("20210101"))
+	first, err := fetcherFor(t, New(Options{Seed: 7, Articles: 50})).Fetch(context.Background(), jan1)
+	assert.Nil(t, err)
+	assert.Len(t, first, 50)
+	again, _ := fetcherFor(t, New(Options{Seed: 7, Articles: 50})).Fetch(context.Background(), jan1)
+	assert.Equal(t, first, again)
+	other, _ := fetcherFor(t, New(Options{Seed: 8, Articles: 50})).Fetch(context.Background(), jan1)
+	assert.NotEqual(t, first, other)
+	nextDay, _ := fetcherFor(t, New(Options{Seed: 7, Articles: 50})).Fetch(context.Background(), storage.NewKey(constants.DEFAULT_PROJECT, constants.ACCESS_ALL, day("20210102")))
+	assert.NotEqual(t, first, nextDay)
+	for i := 1; i < len(first); i++ {
+		assert.GreaterOrEqual(t, first[i-1].Views, first[i].Views)
+	}
+}
+
+func Test_Server_Consistent(t *testing.T) {
+	s := New(Options{Seed: 1, Articles: 20})
+	fetcher := fetcherFor(t, s)
+	jan1 := day("20210101")
+	top, err := fetcher.Fetch(context.Background(), storage.NewKey("de.wikipedia", constants.ACCESS_ALL, jan1))
+	assert.Nil(t, err)
+	for _, article := range []string{top[0].Name, top[19].Name, "AC/DC"} {
+		total := 0
+		for _, access := range []string{constants.ACCESS_DESKTOP, constants.ACCESS_MOBILE_APP, constants.ACCESS_MOBILE_WEB} {
+			total += s.Views("de.wikipedia", access, article, jan1)
+		}
+		assert.Equal(t, s.Views("de.wikipedia", constants.ACCESS_ALL, article, jan1), total, article)
+		series, err := fetcher.FetchArticle(context.Background(), "de.wikipedia", constants.ACCESS_ALL, article, jan1, day("20210103"))
+		assert.Nil(t, err)
+		assert.Len(t, series, 3)
+		assert.Equal(t, article, series[0].Name)
+		assert.Equal(t, total, series[0].Views)
+		assert.Equal(t, day("20210103"), series[2].Date)
+	}
+	//articles outside the top lists are much less viewed than the last one in
+	assert.Less(t, s.Views("de.wikipedia", constants.ACCESS_ALL, "AC/DC", jan1), top[19].Views)
+}
+
+func Test_Server_Faults(t *testing.T) {
+	faults, err := ParseFaults("20210101=404,20210102=503*2,20210103=503,20210104=429*1,20210105=50ms")
+	assert.Nil(t, err)
+	fetcher := fetcherFor(t, New(Options{Articles: 10, Faults: faults}))
+	fetch := func(d string) error {
+		_, err := fetcher.Fetch(context.Background(), storage.NewKey(constants.DEFAULT_PROJECT, constants.ACCESS_ALL, day(d)))
+		return err
+	}
+	assert.ErrorIs(t, fetch("20210101"), indexer.ErrNoData)
+	assert.Nil(t, fetch("20210102"), "succeeds on the third attempt")
+	err = fetch("20210103")
+	assert.NotNil(t, err)
+	assert.NotErrorIs(t, err, indexer.ErrNoData)
+	assert.Nil(t, fetch("20210104"))
+	start := time.Now()
+	assert.Nil(t, fetch("20210105"))
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	assert.Nil(t, fetch("20210106"))
+
+	//a per-article range covering a 404 day fails as a whole
+	_, err = fetcher.FetchArticle(context.Background(), constants.DEFAULT_PROJECT, constants.ACCESS_ALL, "Main_Page", day("20201231"), day("20210101"))
+	assert.ErrorIs(t, err, indexer.ErrNoData)
+}
+
+func Test_Server_BadRequests(t *testing.T) {
+	server := httptest.NewServer(New(Options{}))
+	defer server.Close()
+	for path, status := range map[string]int{
+		"/top/en.wikipedia/all-agents/2021/01/01":                                 http.StatusBadRequest,
+		"/top/en.wikipedia/all-access/2021/02/30":                                 http.StatusBadRequest,
+		"/per-article/en.wikipedia/all-access/spider/Foo/daily/20210101/20210102": http.StatusBadRequest,
+		"/per-article/en.wikipedia/all-access/user/Foo/daily/20210102/20210101":   http.StatusBadRequest,
+		"/unique-devices/en.wikipedia/all-sites/daily/20210101/20210102":          http.StatusNotFound,
+	} {
+		resp, err := http.Get(server.URL + path)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, status, resp.StatusCode, path)
+	}
+}
+
+func Test_ParseFaults(t *testing.T) {
+	faults, err := ParseFaults(" 20210101=404, 20210102=503*2,20210103=1500ms,")
+	assert.Nil(t, err)
+	assert.Equal(t, []Fault{
+		{Day: day("20210101"), Status: 404},
+		{Day: day("20210102"), Status: 503, Times: 2},
+		{Day: day("20210103"), Latency: 1500 * time.Millisecond},
+	}, faults)
+	assert.Equal(t, "20210102=503*2", faults[1].String())
+	for _, bad := range []string{"20210101", "2021-01-01=404", "20210101=200", "20210101=503*0", "20210101=slow", "20210101=-1s"} {
+		_, err = ParseFaults(bad)
+		assert.NotNil(t, err, bad)
+	}
+}
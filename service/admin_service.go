@@ -0,0 +1,76 @@
+package service
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"pelotechfun/indexer"
+	"pelotechfun/storage"
+	"time"
+)
+
+// Function DoExportSnapshot streams the whole day cache as a gzip'd JSON Lines snapshot file
+func DoExportSnapshot(w http.ResponseWriter, r *http.Request) {
+	filename := fmt.Sprintf("wikiapi-snapshot-%s.jsonl.gz", time.Now().UTC().Format("20060102T150405Z"))
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+filename+"\"")
+	days, err := storage.Export(r.Context(), indexer.DB, w)
+	if err != nil {
+		//headers and part of the body are already sent, so all we can do is log and cut the stream short
+		log.Errorf("Snapshot export failed after %d days: %v", days, err)
+		return
+	}
+	log.Infof("Exported snapshot of %d days", days)
+}
+
+// Function DoImportSnapshot loads a snapshot file from the request body into the day cache
+func DoImportSnapshot(w http.ResponseWriter, r *http.Request) {
+	days, err := storage.Import(r.Context(), indexer.DB, r.Body)
+	if err != nil {
+		message := fmt.Sprintf("Snapshot import failed after %d days: %v", days, err)
+		log.Error(message)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(message))
+		return
+	}
+	log.Infof("Imported snapshot of %d days", days)
+	bytes, _ := json.Marshal(map[string]int{"days": days})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
+
+// Function RequireToken is middleware that rejects requests without an "Authorization: Bearer <token>" header
+// matching token. An empty token fails closed: every request is refused with a 403, since the admin endpoints can
+// overwrite and download the whole cache
+func RequireToken(token string) func(http.Handler) http.Handler {
+	expected := []byte("Bearer " + token)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(token) == 0 {
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte("Admin endpoints are disabled until an admin token is configured"))
+				return
+			}
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte("Missing or bad admin token"))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Function DoGetCircuitBreakerStatus reports the state of the circuit breaker around the Wikipedia fetcher
+func DoGetCircuitBreakerStatus(w http.ResponseWriter, r *http.Request) {
+	bytes, err := json.Marshal(indexer.Breaker.Status())
+	if err != nil {
+		log.Error("Failed to marshal reply:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
@@ -0,0 +1,35 @@
+package service
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_RequireToken(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	tests := []struct {
+		name   string
+		token  string
+		header string
+		want   int
+	}{
+		{name: "right token", token: "s3cret", header: "Bearer s3cret", want: http.StatusOK},
+		{name: "wrong token", token: "s3cret", header: "Bearer guess", want: http.StatusUnauthorized},
+		{name: "no header", token: "s3cret", want: http.StatusUnauthorized},
+		{name: "unset token refuses everything", token: "", want: http.StatusForbidden},
+		{name: "unset token refuses an empty bearer", token: "", header: "Bearer ", want: http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/admin/snapshot", nil)
+			if len(test.header) > 0 {
+				r.Header.Set("Authorization", test.header)
+			}
+			w := httptest.NewRecorder()
+			RequireToken(test.token)(ok).ServeHTTP(w, r)
+			assert.Equal(t, test.want, w.Code)
+		})
+	}
+}
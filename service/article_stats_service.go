@@ -2,19 +2,42 @@
 package service
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/go-chi/chi/v5"
 	log "github.com/sirupsen/logrus"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/metric"
+	"math"
 	"net/http"
 	"pelotechfun/constants"
 	"pelotechfun/indexer"
+	"pelotechfun/messages"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 )
 
-var Meter = otel.Meter("article-stats-service")
+var Meter = otel.Meter(constants.METER_NAME)
+
+// Var MaxDayInterval is the widest date range a request may ask for. It can be raised at startup now that outbound
+// calls are rate limited; zero or less removes the cap
+var MaxDayInterval = constants.MAXDAYINTERVAL
+
+// projectPattern matches Wikimedia project names as the Pageviews API spells them, e.g. de.wikipedia or commons.wikimedia
+var projectPattern = regexp.MustCompile(`^[a-z0-9-]+(\.[a-z0-9-]+)+$`)
+
+// accessMethods are the values the Pageviews API accepts for access
+var accessMethods = map[string]bool{
+	constants.ACCESS_ALL:        true,
+	constants.ACCESS_DESKTOP:    true,
+	constants.ACCESS_MOBILE_APP: true,
+	constants.ACCESS_MOBILE_WEB: true,
+}
+
 var mostViewedResultsCounter, _ = Meter.Int64UpDownCounter(
 	"most_viewed_results",
 	metric.WithUnit("1"),
@@ -24,6 +47,10 @@ var mostViewedResultsCounter, _ = Meter.Int64UpDownCounter(
 // Function DoCalcMostViewedDayInMonthForArticle returns the day in a specified month
 // when an article had the most views
 func DoCalcMostViewedDayInMonthForArticle(w http.ResponseWriter, r *http.Request) {
+	project, projectok := validateProjectParam(w, r)
+	if !projectok {
+		return
+	}
 	articleName, articleok := validateArticleParam(w, r)
 	if !articleok {
 		return
@@ -41,49 +68,43 @@ func DoCalcMostViewedDayInMonthForArticle(w http.ResponseWriter, r *http.Request
 
 	onemonthlater := firstOfTheMonth.AddDate(0, 1, 0)
 	firstOfNextMonth := time.Date(onemonthlater.Year(), onemonthlater.Month(), 1, 0, 0, 0, 0, onemonthlater.Location())
-	result, err := indexer.GetTopDayForArticle(articleName, firstOfTheMonth, firstOfNextMonth)
-	mostViewedResultsCounter.Add(r.Context(), int64(len(result.ArticleCounts)))
-	if err != nil {
-		log.Error(err.Error())
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(err.Error()))
-		return
-	}
-	var bytes []byte
-	if bytes, err = json.Marshal(&result); err != nil {
-		log.Error("Failed to marshal reply:", err)
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(bytes)
+	writeQueryResult(w, r, func(ctx context.Context, access string, partial bool) (messages.ArticleCountsForDateRange, error) {
+		result, err := indexer.GetTopDayForArticle(ctx, project, access, articleName, firstOfTheMonth, firstOfNextMonth, partial)
+		mostViewedResultsCounter.Add(ctx, int64(len(result.ArticleCounts)))
+		return result, err
+	})
 }
 
-// Function DoGetArticleCountsForDateRange will return a list of articles ranked by cumulative views in a date range
+// Function DoGetArticleCountsForDateRange will return a list of articles ranked by cumulative views in a date range,
+// a page at a time if ?limit= is given, and leaving out the articles its filter params exclude
 func DoGetArticleCountsForDateRange(w http.ResponseWriter, r *http.Request) {
+	project, projectok := validateProjectParam(w, r)
+	if !projectok {
+		return
+	}
 	start, end, ok := validateDates(w, r)
 	if !ok {
 		return
 	}
-	result, err := indexer.GetArticleCountsForDateRange(start, end)
-	if err != nil {
-		log.Error(err.Error())
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(err.Error()))
+	page, ok := validatePageParams(w, r)
+	if !ok {
 		return
 	}
-	var bytes []byte
-	if bytes, err = json.Marshal(&result); err != nil {
-		log.Error("Failed to marshal reply:", err)
-		w.WriteHeader(http.StatusBadRequest)
+	filter, ok := validateFilterParams(w, r, project)
+	if !ok {
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(bytes)
+	writeQueryResult(w, r, func(ctx context.Context, access string, partial bool) (messages.ArticleCountsForDateRange, error) {
+		return indexer.GetArticleCountsForDateRange(ctx, project, access, start, end, partial, page, filter)
+	})
 }
 
 // Function DoCalcViewCountForArticle will return the aggregate view count for a specific article in a date range
 func DoCalcViewCountForArticle(w http.ResponseWriter, r *http.Request) {
+	project, projectok := validateProjectParam(w, r)
+	if !projectok {
+		return
+	}
 	start, end, ok := validateDates(w, r)
 	if !ok {
 		return
@@ -92,15 +113,59 @@ func DoCalcViewCountForArticle(w http.ResponseWriter, r *http.Request) {
 	if !articleok {
 		return
 	}
-	result, err := indexer.GetCountsForArticleInRange(articleName, start, end)
+	writeQueryResult(w, r, func(ctx context.Context, access string, partial bool) (messages.ArticleCountsForDateRange, error) {
+		return indexer.GetCountsForArticleInRange(ctx, project, access, articleName, start, end, partial)
+	})
+}
+
+// Function DoGetTimeSeriesForArticle will return an article's views for every day in a date range, for plotting
+func DoGetTimeSeriesForArticle(w http.ResponseWriter, r *http.Request) {
+	project, projectok := validateProjectParam(w, r)
+	if !projectok {
+		return
+	}
+	start, end, ok := validateDates(w, r)
+	if !ok {
+		return
+	}
+	articleName, articleok := validateArticleParam(w, r)
+	if !articleok {
+		return
+	}
+	writeQueryResult(w, r, func(ctx context.Context, access string, partial bool) (messages.ArticleCountsForDateRange, error) {
+		return indexer.GetTimeSeriesForArticle(ctx, project, access, articleName, start, end, partial)
+	})
+}
+
+// Function writeQueryResult runs an indexer query for the access method chosen by the request's query string and
+// writes the result as JSON. ?access= picks one method (all-access by default); ?breakdown=access instead runs the
+// query for each of desktop, mobile-app and mobile-web and replies with the results side by side. The query runs with
+// the request's context, so it stops when the client goes away or the request deadline passes. ?partial=true asks for
+// whatever days can be read rather than failing on the first that can't; the reply then lists the days left out
+func writeQueryResult(w http.ResponseWriter, r *http.Request, query func(ctx context.Context, access string, partial bool) (messages.ArticleCountsForDateRange, error)) {
+	access, breakdown, ok := validateAccessParams(w, r)
+	if !ok {
+		return
+	}
+	partial, ok := validatePartialParam(w, r)
+	if !ok {
+		return
+	}
+	var result any
+	var err error
+	if breakdown {
+		result, err = indexer.GetAccessBreakdown(r.Context(), func(ctx context.Context, access string) (messages.ArticleCountsForDateRange, error) {
+			return query(ctx, access, partial)
+		})
+	} else {
+		result, err = query(r.Context(), access, partial)
+	}
 	if err != nil {
-		log.Error(err.Error())
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(err.Error()))
+		writeIndexerError(w, err)
 		return
 	}
 	var bytes []byte
-	if bytes, err = json.Marshal(&result); err != nil {
+	if bytes, err = json.Marshal(result); err != nil {
 		log.Error("Failed to marshal reply:", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
@@ -109,6 +174,52 @@ func DoCalcViewCountForArticle(w http.ResponseWriter, r *http.Request) {
 	w.Write(bytes)
 }
 
+// Function writeIndexerError reports a failed indexer call. Fetches refused by the open circuit breaker are a 503
+// with a Retry-After header, unusable responses from Wikipedia a 502, queries that ran past the request deadline a
+// 504, anything else is a 400. Nothing is written for a client that has gone away
+func writeIndexerError(w http.ResponseWriter, err error) {
+	if errors.Is(err, context.Canceled) {
+		log.Infof("Client went away: %v", err)
+		return
+	}
+	log.Error(err.Error())
+	if errors.Is(err, indexer.ErrTimeout) {
+		w.WriteHeader(http.StatusGatewayTimeout)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	var circuitErr *indexer.CircuitOpenError
+	if errors.As(err, &circuitErr) {
+		retryAfter := int(math.Ceil(time.Until(circuitErr.RetryAt).Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(max(retryAfter, 1)))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if errors.Is(err, indexer.ErrMalformedPayload) {
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write([]byte(err.Error()))
+}
+
+// Function Deadline is middleware that gives each request's context a deadline timeout from now, so queries still
+// running then are abandoned and answered with a 504. Zero or less leaves requests without a deadline
+func Deadline(timeout time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if timeout <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
 // Function validateArticleParam checks for the presence of an article.  Strictly speaking it isn't needed with the current
 // rounting setup as if the argument is missing the middleware will catch it, but it's here for completeness if routing were to change.
 func validateArticleParam(w http.ResponseWriter, r *http.Request) (string, bool) {
@@ -123,6 +234,156 @@ func validateArticleParam(w http.ResponseWriter, r *http.Request) (string, bool)
 	return articleName, true
 }
 
+// Function validateProjectParam reads the wiki project from the route, e.g. /de.wikipedia/mostviewed/..., defaulting
+// to en.wikipedia for the original routes without one
+func validateProjectParam(w http.ResponseWriter, r *http.Request) (string, bool) {
+	project := chi.URLParam(r, "project")
+	if len(project) == 0 {
+		return constants.DEFAULT_PROJECT, true
+	}
+	if !projectPattern.MatchString(project) {
+		message := "Bad project value: " + project + ". Should be a Wikimedia project such as de.wikipedia or commons.wikimedia"
+		log.Error(message)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(message))
+		return "", false
+	}
+	return project, true
+}
+
+// Function validateAccessParams reads the optional access and breakdown query params. Returns the access method to
+// query and whether a per-access-method breakdown was asked for instead
+func validateAccessParams(w http.ResponseWriter, r *http.Request) (string, bool, bool) {
+	access := r.URL.Query().Get("access")
+	breakdown := r.URL.Query().Get("breakdown")
+	message := ""
+	switch {
+	case len(breakdown) > 0 && breakdown != "access":
+		message = "Bad breakdown value: " + breakdown + ". The only supported breakdown is: access"
+	case len(breakdown) > 0 && len(access) > 0:
+		message = "access and breakdown cannot be used together"
+	case len(access) > 0 && !accessMethods[access]:
+		message = "Bad access value: " + access + ". Should be one of: all-access, desktop, mobile-app, mobile-web"
+	}
+	if len(message) > 0 {
+		log.Error(message)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(message))
+		return "", false, false
+	}
+	if len(access) == 0 {
+		access = constants.DEFAULT_ACCESS
+	}
+	return access, len(breakdown) > 0, true
+}
+
+// Function validatePageParams reads the optional limit, offset and cursor query params that page through a ranking.
+// A cursor is the next value of the previous page's reply, so it can't be combined with an offset, nor with a
+// breakdown, whose access methods each have their own next page
+func validatePageParams(w http.ResponseWriter, r *http.Request) (indexer.Page, bool) {
+	page := indexer.Page{Cursor: r.URL.Query().Get("cursor")}
+	message := ""
+	limitstr, offsetstr := r.URL.Query().Get("limit"), r.URL.Query().Get("offset")
+	var err error
+	if len(limitstr) > 0 {
+		if page.Limit, err = strconv.Atoi(limitstr); err != nil || page.Limit < 1 {
+			message = "Bad limit value: " + limitstr + ". Should be a positive number"
+		}
+	}
+	if len(offsetstr) > 0 {
+		if page.Offset, err = strconv.Atoi(offsetstr); err != nil || page.Offset < 0 {
+			message = "Bad offset value: " + offsetstr + ". Should be zero or a positive number"
+		}
+	}
+	switch {
+	case len(page.Cursor) > 0 && len(offsetstr) > 0:
+		message = "cursor and offset cannot be used together"
+	case len(page.Cursor) > 0 && len(r.URL.Query().Get("breakdown")) > 0:
+		message = "cursor and breakdown cannot be used together"
+	}
+	if len(message) > 0 {
+		log.Error(message)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(message))
+		return indexer.Page{}, false
+	}
+	return page, true
+}
+
+// Function validateFilterParams reads the optional query params that filter a ranking of project's articles by name:
+// ?filter=articles keeps only encyclopedia articles, for the projects indexer.ArticlesOnly knows, ?excludens= drops a
+// comma separated list of namespaces, ?include= and ?exclude= take regular expressions and ?includeprefix= and
+// ?excludeprefix= plain prefixes. All but filter may be repeated. Articles are kept if they match none of the
+// exclusions and, if there are any inclusions, at least one of those
+func validateFilterParams(w http.ResponseWriter, r *http.Request, project string) (indexer.NameFilter, bool) {
+	query := r.URL.Query()
+	filter := indexer.NameFilter{}
+	message := ""
+	switch preset := query.Get("filter"); preset {
+	case "":
+	case "articles":
+		var known bool
+		if filter, known = indexer.ArticlesOnly(project); !known {
+			message = "Bad filter value: articles is not supported for " + project + ", whose namespace names are unknown"
+		}
+	default:
+		message = "Bad filter value: " + preset + ". The only supported filter is: articles"
+	}
+	for _, namespaces := range query["excludens"] {
+		for _, namespace := range strings.Split(namespaces, ",") {
+			if len(namespace) == 0 || strings.Contains(namespace, ":") {
+				message = "Bad excludens value: " + namespaces + ". Should be namespace names separated by commas, e.g. Special,File"
+				break
+			}
+			filter.ExcludeNamespaces = append(filter.ExcludeNamespaces, namespace)
+		}
+	}
+	for _, param := range []string{"include", "exclude"} {
+		for _, expr := range query[param] {
+			pattern, err := regexp.Compile(expr)
+			if err != nil {
+				message = "Bad " + param + " value: " + err.Error()
+				break
+			}
+			if param == "include" {
+				filter.Include = append(filter.Include, pattern)
+			} else {
+				filter.Exclude = append(filter.Exclude, pattern)
+			}
+		}
+	}
+	for _, prefix := range query["includeprefix"] {
+		filter.Include = append(filter.Include, indexer.PrefixPattern(prefix))
+	}
+	for _, prefix := range query["excludeprefix"] {
+		filter.Exclude = append(filter.Exclude, indexer.PrefixPattern(prefix))
+	}
+	if len(message) > 0 {
+		log.Error(message)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(message))
+		return indexer.NameFilter{}, false
+	}
+	return filter, true
+}
+
+// Function validatePartialParam reads the optional partial query param, false by default
+func validatePartialParam(w http.ResponseWriter, r *http.Request) (bool, bool) {
+	partialstr := r.URL.Query().Get("partial")
+	if len(partialstr) == 0 {
+		return false, true
+	}
+	partial, err := strconv.ParseBool(partialstr)
+	if err != nil {
+		message := "Bad partial value: " + partialstr + ". Should be true or false"
+		log.Error(message)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(message))
+		return false, false
+	}
+	return partial, true
+}
+
 // Function validateDates does basic date parsing and validation. Will return parsed start
 // and end dates if successful with a true boolean or placeholders with a false boolean value if unsuccessfulX
 func validateDates(w http.ResponseWriter, r *http.Request) (time.Time, time.Time, bool) {
@@ -152,8 +413,8 @@ func validateDates(w http.ResponseWriter, r *http.Request) (time.Time, time.Time
 		return time.Now(), time.Now(), false
 	}
 
-	if end.Sub(start).Hours()/24 >= constants.MAXDAYINTERVAL {
-		message := fmt.Sprintf("Maximum interval between dates is: %d days ", constants.MAXDAYINTERVAL)
+	if MaxDayInterval > 0 && end.Sub(start).Hours()/24 >= float64(MaxDayInterval) {
+		message := fmt.Sprintf("Maximum interval between dates is: %d days ", MaxDayInterval)
 		log.Error(message)
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(message))
@@ -0,0 +1,206 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"pelotechfun/constants"
+	"pelotechfun/messages"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+var (
+	Meter               = otel.Meter(constants.METER_NAME)
+	cacheHitsCounter, _ = Meter.Int64Counter(
+		"storage_cache_hits",
+		metric.WithUnit("1"),
+		metric.WithDescription("number of day lookups served from the bounded in-memory cache"),
+	)
+	cacheMissesCounter, _ = Meter.Int64Counter(
+		"storage_cache_misses",
+		metric.WithUnit("1"),
+		metric.WithDescription("number of day lookups not found (or expired) in the bounded in-memory cache"),
+	)
+	cacheEvictionsCounter, _ = Meter.Int64Counter(
+		"storage_cache_evictions",
+		metric.WithUnit("1"),
+		metric.WithDescription("number of days removed from the bounded in-memory cache, by reason"),
+	)
+	evictedForCapacity = metric.WithAttributes(attribute.String("reason", "capacity"))
+	evictedForExpiry   = metric.WithAttributes(attribute.String("reason", "expired"))
+)
+
+// approximate in-memory footprint of one ArticleCount, not counting the bytes of its name
+const articleCountOverhead = int64(unsafe.Sizeof(messages.ArticleCount{}))
+
+// Limits for a BoundedStorage. Zero values mean "no limit" for that dimension
+type BoundedStorageOptions struct {
+	// MaxDays caps the number of days held
+	MaxDays int
+	// MaxBytes caps the approximate memory used by the held days
+	MaxBytes int64
+	// TTL is how long a historical day stays cached after it was Put
+	TTL time.Duration
+	// RecentTTL is used instead of TTL for days within RecentWindow of now, since Wikipedia may still revise those
+	RecentTTL    time.Duration
+	RecentWindow time.Duration
+}
+
+// A threadsafe in-memory cache that evicts the least recently used days once MaxDays or MaxBytes is exceeded and drops
+// days whose TTL has passed. The most recently Put day is always kept, even if it alone exceeds MaxBytes. Implements Storage interface
+type BoundedStorage struct {
+	options BoundedStorageOptions
+	entries map[Key]*list.Element
+	lru     *list.List
+	bytes   int64
+	mutex   sync.Mutex
+	now     func() time.Time
+}
+
+type boundedEntry struct {
+	key     Key
+	value   []messages.ArticleCount
+	size    int64
+	expires time.Time
+}
+
+// factory for a BoundedStorage instance
+func NewBoundedStorage(options BoundedStorageOptions) *BoundedStorage {
+	return &BoundedStorage{
+		options: options,
+		entries: make(map[Key]*list.Element),
+		lru:     list.New(),
+		now:     time.Now,
+	}
+}
+
+// Add an article day count, evicting older days if that pushes the cache over its limits
+func (t *BoundedStorage) Put(key Key, value []messages.ArticleCount) {
+	key = key.normalize()
+	entry := &boundedEntry{
+		key:     key,
+		value:   value,
+		size:    approxSize(value),
+		expires: t.expiry(key),
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if element, ok := t.entries[key]; ok {
+		t.remove(element)
+	}
+	t.entries[key] = t.lru.PushFront(entry)
+	t.bytes += entry.size
+	evicted := int64(0)
+	for t.overLimit() && t.lru.Len() > 1 {
+		t.remove(t.lru.Back())
+		evicted++
+	}
+	if evicted > 0 {
+		cacheEvictionsCounter.Add(context.Background(), evicted, evictedForCapacity)
+	}
+}
+
+// Retrieve an article day count. Second return value will be true if the key is present and not expired
+func (t *BoundedStorage) Get(key Key) ([]messages.ArticleCount, bool) {
+	key = key.normalize()
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	element, ok := t.entries[key]
+	if !ok {
+		cacheMissesCounter.Add(context.Background(), 1)
+		return nil, false
+	}
+	entry := element.Value.(*boundedEntry)
+	if !entry.expires.IsZero() && !t.now().Before(entry.expires) {
+		t.remove(element)
+		cacheEvictionsCounter.Add(context.Background(), 1, evictedForExpiry)
+		cacheMissesCounter.Add(context.Background(), 1)
+		return nil, false
+	}
+	t.lru.MoveToFront(element)
+	cacheHitsCounter.Add(context.Background(), 1)
+	return entry.value, true
+}
+
+// Remove an article day count if present
+func (t *BoundedStorage) Delete(key Key) {
+	key = key.normalize()
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if element, ok := t.entries[key]; ok {
+		t.remove(element)
+	}
+}
+
+// Visit every unexpired day without affecting recency. Works on a snapshot so fn is free to call back into the store
+func (t *BoundedStorage) Range(fn func(key Key, value []messages.ArticleCount) bool) {
+	t.mutex.Lock()
+	now := t.now()
+	snapshot := make([]*boundedEntry, 0, t.lru.Len())
+	for element := t.lru.Front(); element != nil; element = element.Next() {
+		entry := element.Value.(*boundedEntry)
+		if entry.expires.IsZero() || now.Before(entry.expires) {
+			snapshot = append(snapshot, entry)
+		}
+	}
+	t.mutex.Unlock()
+	for _, entry := range snapshot {
+		if !fn(entry.key, entry.value) {
+			return
+		}
+	}
+}
+
+// Report the RecentTTL a day is cached for if it is recent, so a TieredStorage can apply it to its other tiers
+func (t *BoundedStorage) RecentTTL(key Key) (time.Duration, bool) {
+	if t.options.RecentTTL > 0 && t.now().Sub(key.normalize().Day) < t.options.RecentWindow {
+		return t.options.RecentTTL, true
+	}
+	return 0, false
+}
+
+// expiry works out when a day Put now should expire, or the zero time if it never should
+func (t *BoundedStorage) expiry(key Key) time.Time {
+	now := t.now()
+	ttl := t.options.TTL
+	if recentTTL, recent := t.RecentTTL(key); recent {
+		ttl = recentTTL
+	}
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return now.Add(ttl)
+}
+
+// overLimit must be called with the mutex held
+func (t *BoundedStorage) overLimit() bool {
+	return (t.options.MaxDays > 0 && t.lru.Len() > t.options.MaxDays) ||
+		(t.options.MaxBytes > 0 && t.bytes > t.options.MaxBytes)
+}
+
+// remove must be called with the mutex held
+func (t *BoundedStorage) remove(element *list.Element) {
+	entry := t.lru.Remove(element).(*boundedEntry)
+	delete(t.entries, entry.key)
+	t.bytes -= entry.size
+}
+
+// approxSize estimates the memory held by a day's worth of counts
+func approxSize(value []messages.ArticleCount) int64 {
+	size := int64(0)
+	for _, count := range value {
+		size += articleCountOverhead + int64(len(count.Name))
+	}
+	return size
+}
+
+// non-exported helper function for testing
+func (t *BoundedStorage) size() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.lru.Len()
+}
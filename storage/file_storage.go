@@ -0,0 +1,296 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"pelotechfun/constants"
+	"pelotechfun/messages"
+	"strings"
+	"time"
+)
+
+const fileStorageExt = ".json"
+
+// A disk-backed store that keeps one JSON file per truncated day in a subdirectory per project and access method,
+// e.g. dir/en.wikipedia/all-access/20210101.json, so cached counts survive restarts. Writes go to a temp file that is renamed into
+// place, so readers never see a partially written day. Implements ContextStorage interface
+type FileStorage struct {
+	dir string
+}
+
+// factory for a FileStorage instance rooted at dir. The directory is created if it does not exist, and days cached in
+// the layouts of earlier versions are migrated to the current one
+func NewFileStorage(dir string) (*FileStorage, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	t := &FileStorage{dir: dir}
+	migrated, err := t.migrate()
+	if err != nil {
+		return nil, fmt.Errorf("migrating %s: %w", dir, err)
+	}
+	if migrated > 0 {
+		log.Infof("Migrated %d cached days in %s to the per-project, per-access-method layout", migrated, dir)
+	}
+	return t, nil
+}
+
+// migrate moves days written by earlier versions into the current layout. Day files directly under dir predate
+// projects and are en.wikipedia's; day files directly under a project directory predate access methods and are
+// all-access. A day already in the current layout was fetched since, so the old file is dropped instead. Returns the
+// number of days moved
+func (t *FileStorage) migrate() (int, error) {
+	migrated, err := t.migrateDays(t.dir, constants.DEFAULT_PROJECT)
+	if err != nil {
+		return migrated, err
+	}
+	projects, err := t.subdirs(t.dir)
+	if err != nil {
+		return migrated, err
+	}
+	for _, project := range projects {
+		moved, err := t.migrateDays(filepath.Join(t.dir, project), project)
+		migrated += moved
+		if err != nil {
+			return migrated, err
+		}
+	}
+	return migrated, nil
+}
+
+// migrateDays moves the day files directly in dir to project's all-access directory
+func (t *FileStorage) migrateDays(dir string, project string) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	migrated := 0
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), fileStorageExt)
+		if !ok || entry.IsDir() {
+			continue
+		}
+		day, err := time.Parse(constants.DATELAYOUT, name)
+		if err != nil {
+			continue
+		}
+		target, err := t.path(NewKey(project, constants.DEFAULT_ACCESS, day))
+		if err != nil {
+			return migrated, err
+		}
+		legacy := filepath.Join(dir, entry.Name())
+		if _, err = os.Stat(target); err == nil {
+			if err = os.Remove(legacy); err != nil {
+				return migrated, err
+			}
+			continue
+		}
+		if err = os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return migrated, err
+		}
+		if err = os.Rename(legacy, target); err != nil {
+			return migrated, err
+		}
+		migrated++
+	}
+	return migrated, nil
+}
+
+// Add an article day count
+func (t *FileStorage) Put(ctx context.Context, key Key, value []messages.ArticleCount) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	path, err := t.path(key)
+	if err != nil {
+		return err
+	}
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(bytes); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Retrieve an article day count. Second return value will be true if the key is present
+func (t *FileStorage) Get(ctx context.Context, key Key) ([]messages.ArticleCount, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+	path, err := t.path(key)
+	if err != nil {
+		return nil, false, err
+	}
+	value, err := t.read(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+// Remove an article day count. Deleting a missing day is not an error
+func (t *FileStorage) Delete(ctx context.Context, key Key) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	path, err := t.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Check for an article day count without reading it
+func (t *FileStorage) Has(ctx context.Context, key Key) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	path, err := t.path(key)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Visit every stored day, project by project and access method by access method in name order, then in date order.
+// Files that are not day files are ignored
+func (t *FileStorage) Range(ctx context.Context, fn func(key Key, value []messages.ArticleCount) bool) error {
+	projects, err := t.subdirs(t.dir)
+	if err != nil {
+		return err
+	}
+	for _, project := range projects {
+		accesses, err := t.subdirs(filepath.Join(t.dir, project))
+		if err != nil {
+			return err
+		}
+		for _, access := range accesses {
+			more, err := t.rangeDays(ctx, project, access, fn)
+			if err != nil || !more {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// subdirs lists the directories under dir that could have been written by path. A directory removed since it was
+// listed has none
+func (t *FileStorage) subdirs(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() && validPathElement(entry.Name()) {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+// rangeDays visits the days of one project and access method. The bool result is false once fn asks to stop
+func (t *FileStorage) rangeDays(ctx context.Context, project string, access string, fn func(key Key, value []messages.ArticleCount) bool) (bool, error) {
+	dir := filepath.Join(t.dir, project, access)
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, entry := range entries {
+		if err = ctx.Err(); err != nil {
+			return false, err
+		}
+		name, ok := strings.CutSuffix(entry.Name(), fileStorageExt)
+		if !ok || entry.IsDir() {
+			continue
+		}
+		day, err := time.Parse(constants.DATELAYOUT, name)
+		if err != nil {
+			continue
+		}
+		value, err := t.read(filepath.Join(dir, entry.Name()))
+		if errors.Is(err, fs.ErrNotExist) {
+			//deleted since the directory was listed
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if !fn(Key{Project: project, Access: access, Day: day}, value) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (t *FileStorage) read(path string) ([]messages.ArticleCount, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	value := []messages.ArticleCount{}
+	if err = json.Unmarshal(bytes, &value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// path maps a key to its file, using the same day truncation as LocalMapStorage. Fails for project or access names
+// that could escape the directory
+func (t *FileStorage) path(key Key) (string, error) {
+	if !validPathElement(key.Project) {
+		return "", fmt.Errorf("invalid project name %q", key.Project)
+	}
+	if !validPathElement(key.Access) {
+		return "", fmt.Errorf("invalid access method %q", key.Access)
+	}
+	day := key.normalize().Day.Format(constants.DATELAYOUT)
+	return filepath.Join(t.dir, key.Project, key.Access, day+fileStorageExt), nil
+}
+
+// validPathElement accepts names such as "en.wikipedia" or "mobile-app", which are safe to use as a single path element
+func validPathElement(name string) bool {
+	if len(name) == 0 || strings.HasPrefix(name, ".") {
+		return false
+	}
+	return !strings.ContainsAny(name, `/\:`)
+}
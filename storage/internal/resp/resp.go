@@ -0,0 +1,187 @@
+// Package resp is a minimal codec for the Redis serialization protocol (RESP2), shared by the Redis storage client
+// and the in-process fake server used in tests. It supports exactly the reply types Redis commands return.
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// Kind is the RESP type marker that prefixes every value on the wire
+type Kind byte
+
+const (
+	SimpleString Kind = '+'
+	Error        Kind = '-'
+	Integer      Kind = ':'
+	BulkString   Kind = '$'
+	Array        Kind = '*'
+)
+
+// limits that guard against a corrupt or hostile peer asking us to allocate huge buffers
+const (
+	maxBulkLen  = 512 * 1024 * 1024
+	maxArrayLen = 1024 * 1024
+)
+
+// Value is a single decoded RESP value. Null bulk strings and null arrays have Null set
+type Value struct {
+	Kind  Kind
+	Str   string
+	Int   int64
+	Bulk  []byte
+	Array []Value
+	Null  bool
+}
+
+// ServerError is an error reply sent by the server, e.g. "ERR unknown command"
+type ServerError string
+
+func (e ServerError) Error() string {
+	return string(e)
+}
+
+// Constructors for the values servers reply with
+func Simple(s string) Value     { return Value{Kind: SimpleString, Str: s} }
+func Err(s string) Value        { return Value{Kind: Error, Str: s} }
+func Int(i int64) Value         { return Value{Kind: Integer, Int: i} }
+func Bulk(b []byte) Value       { return Value{Kind: BulkString, Bulk: b} }
+func NullBulk() Value           { return Value{Kind: BulkString, Null: true} }
+func Arr(values ...Value) Value { return Value{Kind: Array, Array: values} }
+
+// Write encodes v onto w. The caller is responsible for flushing
+func Write(w *bufio.Writer, v Value) error {
+	w.WriteByte(byte(v.Kind))
+	switch v.Kind {
+	case SimpleString, Error:
+		w.WriteString(v.Str)
+	case Integer:
+		w.WriteString(strconv.FormatInt(v.Int, 10))
+	case BulkString:
+		if v.Null {
+			w.WriteString("-1")
+			break
+		}
+		w.WriteString(strconv.Itoa(len(v.Bulk)))
+		w.WriteString("\r\n")
+		w.Write(v.Bulk)
+	case Array:
+		if v.Null {
+			w.WriteString("-1")
+			break
+		}
+		w.WriteString(strconv.Itoa(len(v.Array)))
+		w.WriteString("\r\n")
+		for _, element := range v.Array {
+			if err := Write(w, element); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("resp: cannot encode kind %q", v.Kind)
+	}
+	_, err := w.WriteString("\r\n")
+	return err
+}
+
+// Read decodes the next value from r
+func Read(r *bufio.Reader) (Value, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return Value{}, err
+	}
+	if len(line) == 0 {
+		return Value{}, errors.New("resp: empty line")
+	}
+	kind, body := Kind(line[0]), string(line[1:])
+	switch kind {
+	case SimpleString, Error:
+		return Value{Kind: kind, Str: body}, nil
+	case Integer:
+		i, err := strconv.ParseInt(body, 10, 64)
+		if err != nil {
+			return Value{}, fmt.Errorf("resp: bad integer %q", body)
+		}
+		return Int(i), nil
+	case BulkString:
+		n, err := strconv.Atoi(body)
+		if err != nil || n < -1 || n > maxBulkLen {
+			return Value{}, fmt.Errorf("resp: bad bulk length %q", body)
+		}
+		if n == -1 {
+			return NullBulk(), nil
+		}
+		buf := make([]byte, n+2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return Value{}, err
+		}
+		return Bulk(buf[:n]), nil
+	case Array:
+		n, err := strconv.Atoi(body)
+		if err != nil || n < -1 || n > maxArrayLen {
+			return Value{}, fmt.Errorf("resp: bad array length %q", body)
+		}
+		if n == -1 {
+			return Value{Kind: Array, Null: true}, nil
+		}
+		values := make([]Value, n)
+		for i := range values {
+			if values[i], err = Read(r); err != nil {
+				return Value{}, err
+			}
+		}
+		return Arr(values...), nil
+	default:
+		return Value{}, fmt.Errorf("resp: unknown type marker %q", line[0])
+	}
+}
+
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, errors.New("resp: line not terminated by CRLF")
+	}
+	return line[:len(line)-2], nil
+}
+
+// Conn is a client connection that sends commands and reads their replies. It is not safe for concurrent use
+type Conn struct {
+	net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+// NewConn wraps an established network connection
+func NewConn(conn net.Conn) *Conn {
+	return &Conn{conn, bufio.NewReader(conn), bufio.NewWriter(conn)}
+}
+
+// Do sends one command and waits for its reply. Error replies are returned as a ServerError
+func (c *Conn) Do(args ...[]byte) (Value, error) {
+	command := make([]Value, len(args))
+	for i, arg := range args {
+		command[i] = Bulk(arg)
+	}
+	if err := Write(c.writer, Arr(command...)); err != nil {
+		return Value{}, err
+	}
+	if err := c.writer.Flush(); err != nil {
+		return Value{}, err
+	}
+	reply, err := Read(c.reader)
+	if err != nil {
+		return Value{}, err
+	}
+	if reply.Kind == Error {
+		return reply, ServerError(reply.Str)
+	}
+	return reply, nil
+}
@@ -0,0 +1,366 @@
+package storage
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"pelotechfun/constants"
+	"pelotechfun/messages"
+	"pelotechfun/storage/internal/resp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// first byte of every encoded day so the format can change without misreading old values
+const redisCodecVersion = 1
+
+// Settings for a RedisStorage. Only Addr is required
+type RedisOptions struct {
+	// Addr is the host:port of the Redis server
+	Addr string
+	// Password is sent with AUTH on connect when set
+	Password string
+	// DB is selected on connect when non-zero
+	DB int
+	// KeyPrefix namespaces our keys so the server can be shared. Defaults to "wikiapi:day:"
+	KeyPrefix string
+	// PoolSize is the number of idle connections kept for reuse. Defaults to 10
+	PoolSize int
+	// Timeout bounds each command when the context has no earlier deadline. Defaults to 5s
+	Timeout time.Duration
+	// TTL sets an expiry on every day written when non-zero
+	TTL time.Duration
+}
+
+// A store shared between API replicas, backed by any server that speaks the Redis RESP protocol. Each project day is
+// one key holding a compact binary encoding of its counts. Implements ContextStorage interface
+type RedisStorage struct {
+	options RedisOptions
+	pool    chan *resp.Conn
+	dialer  net.Dialer
+}
+
+// factory for a RedisStorage instance. Fails if the server cannot be reached
+func NewRedisStorage(ctx context.Context, options RedisOptions) (*RedisStorage, error) {
+	if len(options.KeyPrefix) == 0 {
+		options.KeyPrefix = "wikiapi:day:"
+	}
+	if options.PoolSize <= 0 {
+		options.PoolSize = 10
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = 5 * time.Second
+	}
+	t := &RedisStorage{
+		options: options,
+		pool:    make(chan *resp.Conn, options.PoolSize),
+	}
+	if _, err := t.do(ctx, "PING"); err != nil {
+		return nil, err
+	}
+	if err := t.migrate(ctx); err != nil {
+		return nil, fmt.Errorf("migrating keys: %w", err)
+	}
+	return t, nil
+}
+
+// migrate renames days written by earlier versions to the current key layout. Keys holding only a day predate
+// projects and are en.wikipedia's; keys holding a project and a day predate access methods and are all-access. A day
+// already under its current key was fetched since, so the old key is dropped instead. Safe to run from several
+// replicas at once
+func (t *RedisStorage) migrate(ctx context.Context) error {
+	cursor := "0"
+	migrated := 0
+	for {
+		reply, err := t.do(ctx, "SCAN", cursor, "MATCH", t.options.KeyPrefix+"*", "COUNT", "100")
+		if err != nil {
+			return err
+		}
+		if len(reply.Array) != 2 {
+			return errors.New("unexpected SCAN reply")
+		}
+		cursor = string(reply.Array[0].Bulk)
+		for _, element := range reply.Array[1].Array {
+			legacy := string(element.Bulk)
+			key, ok := t.parseLegacyKey(legacy)
+			if !ok {
+				continue
+			}
+			renamed, err := t.do(ctx, "RENAMENX", legacy, t.key(key))
+			var serverErr resp.ServerError
+			switch {
+			case errors.As(err, &serverErr):
+				//another replica got to it first
+				continue
+			case err != nil:
+				return err
+			case renamed.Int == 0:
+				if _, err = t.do(ctx, "DEL", legacy); err != nil {
+					return err
+				}
+			default:
+				migrated++
+			}
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+	if migrated > 0 {
+		log.Infof("Migrated %d cached days to the per-project, per-access-method key layout", migrated)
+	}
+	return nil
+}
+
+// Add an article day count
+func (t *RedisStorage) Put(ctx context.Context, key Key, value []messages.ArticleCount) error {
+	args := []string{"SET", t.key(key), string(encodeCounts(value))}
+	if t.options.TTL > 0 {
+		args = append(args, "PX", strconv.FormatInt(t.options.TTL.Milliseconds(), 10))
+	}
+	_, err := t.do(ctx, args...)
+	return err
+}
+
+// Retrieve an article day count. Second return value will be true if the key is present
+func (t *RedisStorage) Get(ctx context.Context, key Key) ([]messages.ArticleCount, bool, error) {
+	reply, err := t.do(ctx, "GET", t.key(key))
+	if err != nil {
+		return nil, false, err
+	}
+	if reply.Null {
+		return nil, false, nil
+	}
+	value, err := decodeCounts(reply.Bulk)
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+// Remove an article day count. Deleting a missing day is not an error
+func (t *RedisStorage) Delete(ctx context.Context, key Key) error {
+	_, err := t.do(ctx, "DEL", t.key(key))
+	return err
+}
+
+// Check for an article day count without transferring it
+func (t *RedisStorage) Has(ctx context.Context, key Key) (bool, error) {
+	reply, err := t.do(ctx, "EXISTS", t.key(key))
+	if err != nil {
+		return false, err
+	}
+	return reply.Int > 0, nil
+}
+
+// Visit every stored day using SCAN, so the server is never blocked. As with Redis SCAN, a day written or deleted
+// while ranging may or may not be seen
+func (t *RedisStorage) Range(ctx context.Context, fn func(key Key, value []messages.ArticleCount) bool) error {
+	cursor := "0"
+	for {
+		reply, err := t.do(ctx, "SCAN", cursor, "MATCH", t.options.KeyPrefix+"*", "COUNT", "100")
+		if err != nil {
+			return err
+		}
+		if len(reply.Array) != 2 {
+			return errors.New("unexpected SCAN reply")
+		}
+		cursor = string(reply.Array[0].Bulk)
+		for _, element := range reply.Array[1].Array {
+			key, ok := t.parseKey(string(element.Bulk))
+			if !ok {
+				continue
+			}
+			value, ok, err := t.Get(ctx, key)
+			if err != nil {
+				return err
+			}
+			if ok && !fn(key, value) {
+				return nil
+			}
+		}
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
+
+// key maps a Key to its redis key, e.g. "wikiapi:day:en.wikipedia:all-access:20210101"
+func (t *RedisStorage) key(key Key) string {
+	return t.options.KeyPrefix + key.Project + ":" + key.Access + ":" + key.normalize().Day.Format(constants.DATELAYOUT)
+}
+
+// parseKey reverses key, rejecting anything under our prefix that we did not write
+func (t *RedisStorage) parseKey(redisKey string) (Key, bool) {
+	rest, ok := strings.CutPrefix(redisKey, t.options.KeyPrefix)
+	if !ok {
+		return Key{}, false
+	}
+	//access and day are last, project names may themselves contain colons in principle
+	parts := strings.Split(rest, ":")
+	if len(parts) < 3 {
+		return Key{}, false
+	}
+	day, err := time.Parse(constants.DATELAYOUT, parts[len(parts)-1])
+	if err != nil {
+		return Key{}, false
+	}
+	project := strings.Join(parts[:len(parts)-2], ":")
+	return Key{Project: project, Access: parts[len(parts)-2], Day: day}, true
+}
+
+// parseLegacyKey reads the keys of earlier versions, "<prefix><day>" and "<prefix><project>:<day>"
+func (t *RedisStorage) parseLegacyKey(redisKey string) (Key, bool) {
+	rest, ok := strings.CutPrefix(redisKey, t.options.KeyPrefix)
+	if !ok {
+		return Key{}, false
+	}
+	parts := strings.Split(rest, ":")
+	if len(parts) > 2 {
+		return Key{}, false
+	}
+	day, err := time.Parse(constants.DATELAYOUT, parts[len(parts)-1])
+	if err != nil {
+		return Key{}, false
+	}
+	project := constants.DEFAULT_PROJECT
+	if len(parts) == 2 {
+		project = parts[0]
+	}
+	return NewKey(project, constants.DEFAULT_ACCESS, day), true
+}
+
+// do runs one command on a pooled connection. The connection is discarded on any network or protocol error, and
+// interrupted if ctx is cancelled while the command is in flight
+func (t *RedisStorage) do(ctx context.Context, args ...string) (resp.Value, error) {
+	if err := ctx.Err(); err != nil {
+		return resp.Value{}, err
+	}
+	conn, err := t.acquire(ctx)
+	if err != nil {
+		return resp.Value{}, err
+	}
+	deadline := time.Now().Add(t.options.Timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	bytes := make([][]byte, len(args))
+	for i, arg := range args {
+		bytes[i] = []byte(arg)
+	}
+	reply, err := conn.Do(bytes...)
+	interrupted := !stop()
+	var serverErr resp.ServerError
+	if interrupted || (err != nil && !errors.As(err, &serverErr)) {
+		conn.Close()
+		if interrupted {
+			return resp.Value{}, ctx.Err()
+		}
+		return resp.Value{}, err
+	}
+	t.release(conn)
+	return reply, err
+}
+
+func (t *RedisStorage) acquire(ctx context.Context) (*resp.Conn, error) {
+	select {
+	case conn := <-t.pool:
+		return conn, nil
+	default:
+	}
+	netConn, err := t.dialer.DialContext(ctx, "tcp", t.options.Addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := resp.NewConn(netConn)
+	conn.SetDeadline(time.Now().Add(t.options.Timeout))
+	if len(t.options.Password) > 0 {
+		if _, err = conn.Do([]byte("AUTH"), []byte(t.options.Password)); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("redis AUTH failed: %w", err)
+		}
+	}
+	if t.options.DB != 0 {
+		if _, err = conn.Do([]byte("SELECT"), []byte(strconv.Itoa(t.options.DB))); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("redis SELECT failed: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+func (t *RedisStorage) release(conn *resp.Conn) {
+	select {
+	case t.pool <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// encodeCounts packs counts as a version byte, a count, then per article the name length, name bytes, views and
+// the date as unix seconds (0 for the zero time). Integers are varints, which keeps a typical day to ~30 bytes per article
+func encodeCounts(value []messages.ArticleCount) []byte {
+	buf := make([]byte, 0, 1+binary.MaxVarintLen64+len(value)*32)
+	buf = append(buf, redisCodecVersion)
+	buf = binary.AppendUvarint(buf, uint64(len(value)))
+	for _, count := range value {
+		buf = binary.AppendUvarint(buf, uint64(len(count.Name)))
+		buf = append(buf, count.Name...)
+		buf = binary.AppendVarint(buf, int64(count.Views))
+		date := int64(0)
+		if !count.Date.IsZero() {
+			date = count.Date.Unix()
+		}
+		buf = binary.AppendVarint(buf, date)
+	}
+	return buf
+}
+
+var errCorruptCounts = errors.New("corrupt encoded article counts")
+
+func decodeCounts(buf []byte) ([]messages.ArticleCount, error) {
+	if len(buf) == 0 || buf[0] != redisCodecVersion {
+		return nil, errCorruptCounts
+	}
+	buf = buf[1:]
+	n, read := binary.Uvarint(buf)
+	//every article takes at least 3 bytes, which bounds the allocation for a corrupt length
+	if read <= 0 || n > uint64(len(buf)/3) {
+		return nil, errCorruptCounts
+	}
+	buf = buf[read:]
+	value := make([]messages.ArticleCount, n)
+	for i := range value {
+		nameLen, read := binary.Uvarint(buf)
+		if read <= 0 || nameLen > uint64(len(buf)-read) {
+			return nil, errCorruptCounts
+		}
+		buf = buf[read:]
+		value[i].Name = string(buf[:nameLen])
+		buf = buf[nameLen:]
+		views, read := binary.Varint(buf)
+		if read <= 0 {
+			return nil, errCorruptCounts
+		}
+		buf = buf[read:]
+		value[i].Views = int(views)
+		date, read := binary.Varint(buf)
+		if read <= 0 {
+			return nil, errCorruptCounts
+		}
+		buf = buf[read:]
+		if date != 0 {
+			value[i].Date = time.Unix(date, 0).UTC()
+		}
+	}
+	if len(buf) != 0 {
+		return nil, errCorruptCounts
+	}
+	return value, nil
+}
@@ -0,0 +1,230 @@
+// Package resptest provides an in-process fake Redis server for tests, in the spirit of net/http/httptest. It speaks
+// enough of the RESP protocol (PING, AUTH, SELECT, GET, SET, DEL, EXISTS, RENAMENX, SCAN, DBSIZE, FLUSHALL) to
+// exercise storage.RedisStorage without a real Redis. Keys never expire and SET options are ignored.
+package resptest
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"path"
+	"pelotechfun/storage/internal/resp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Server is a fake Redis listening on a random loopback port
+type Server struct {
+	// Addr is the host:port the server listens on
+	Addr string
+
+	listener net.Listener
+	data     map[string][]byte
+	mutex    sync.Mutex
+	conns    map[net.Conn]struct{}
+	wg       sync.WaitGroup
+}
+
+// NewServer starts a fake server. Callers should Close it when finished
+func NewServer() *Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("resptest: failed to listen on a port: " + err.Error())
+	}
+	s := &Server{
+		Addr:     listener.Addr().String(),
+		listener: listener,
+		data:     make(map[string][]byte),
+		conns:    make(map[net.Conn]struct{}),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+// Close stops the listener and drops every open client connection
+func (s *Server) Close() {
+	s.listener.Close()
+	s.mutex.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mutex.Unlock()
+	s.wg.Wait()
+}
+
+// Keys returns the stored keys in sorted order
+func (s *Server) Keys() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	keys := make([]string, 0, len(s.data))
+	for key := range s.data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mutex.Lock()
+		s.conns[conn] = struct{}{}
+		s.mutex.Unlock()
+		s.wg.Add(1)
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.conns, conn)
+		s.mutex.Unlock()
+		conn.Close()
+	}()
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	for {
+		command, err := resp.Read(reader)
+		if err != nil {
+			return
+		}
+		reply := s.execute(command)
+		if resp.Write(writer, reply) != nil || writer.Flush() != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) execute(command resp.Value) resp.Value {
+	args, err := arguments(command)
+	if err != nil {
+		return resp.Err("ERR " + err.Error())
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	name := strings.ToUpper(string(args[0]))
+	args = args[1:]
+	switch name {
+	case "PING":
+		return resp.Simple("PONG")
+	case "AUTH", "SELECT":
+		return resp.Simple("OK")
+	case "GET":
+		if len(args) != 1 {
+			return wrongArgs(name)
+		}
+		value, ok := s.data[string(args[0])]
+		if !ok {
+			return resp.NullBulk()
+		}
+		return resp.Bulk(value)
+	case "SET":
+		if len(args) < 2 {
+			return wrongArgs(name)
+		}
+		s.data[string(args[0])] = append([]byte(nil), args[1]...)
+		return resp.Simple("OK")
+	case "DEL", "EXISTS":
+		if len(args) == 0 {
+			return wrongArgs(name)
+		}
+		count := int64(0)
+		for _, key := range args {
+			if _, ok := s.data[string(key)]; ok {
+				count++
+				if name == "DEL" {
+					delete(s.data, string(key))
+				}
+			}
+		}
+		return resp.Int(count)
+	case "RENAMENX":
+		if len(args) != 2 {
+			return wrongArgs(name)
+		}
+		value, ok := s.data[string(args[0])]
+		if !ok {
+			return resp.Err("ERR no such key")
+		}
+		if _, exists := s.data[string(args[1])]; exists {
+			return resp.Int(0)
+		}
+		delete(s.data, string(args[0]))
+		s.data[string(args[1])] = value
+		return resp.Int(1)
+	case "SCAN":
+		return s.scan(args)
+	case "DBSIZE":
+		return resp.Int(int64(len(s.data)))
+	case "FLUSHALL", "FLUSHDB":
+		s.data = make(map[string][]byte)
+		return resp.Simple("OK")
+	default:
+		return resp.Err("ERR unknown command '" + name + "'")
+	}
+}
+
+// scan pages through the keys in sorted order, using the offset into that order as the cursor
+func (s *Server) scan(args [][]byte) resp.Value {
+	if len(args) == 0 {
+		return wrongArgs("SCAN")
+	}
+	cursor, err := strconv.Atoi(string(args[0]))
+	if err != nil || cursor < 0 {
+		return resp.Err("ERR invalid cursor")
+	}
+	pattern, count := "*", 10
+	for i := 1; i+1 < len(args); i += 2 {
+		switch strings.ToUpper(string(args[i])) {
+		case "MATCH":
+			pattern = string(args[i+1])
+		case "COUNT":
+			if count, err = strconv.Atoi(string(args[i+1])); err != nil || count < 1 {
+				return resp.Err("ERR syntax error")
+			}
+		}
+	}
+	keys := make([]string, 0, len(s.data))
+	for key := range s.data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	matched := []resp.Value{}
+	next := cursor
+	for ; next < len(keys) && next < cursor+count; next++ {
+		if ok, _ := path.Match(pattern, keys[next]); ok {
+			matched = append(matched, resp.Bulk([]byte(keys[next])))
+		}
+	}
+	if next >= len(keys) {
+		next = 0
+	}
+	return resp.Arr(resp.Bulk([]byte(strconv.Itoa(next))), resp.Arr(matched...))
+}
+
+func arguments(command resp.Value) ([][]byte, error) {
+	if command.Kind != resp.Array || len(command.Array) == 0 {
+		return nil, errors.New("expected a command array")
+	}
+	args := make([][]byte, len(command.Array))
+	for i, arg := range command.Array {
+		if arg.Kind != resp.BulkString || arg.Null {
+			return nil, errors.New("expected bulk string arguments")
+		}
+		args[i] = arg.Bulk
+	}
+	return args, nil
+}
+
+func wrongArgs(name string) resp.Value {
+	return resp.Err("ERR wrong number of arguments for '" + strings.ToLower(name) + "' command")
+}
@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"pelotechfun/constants"
+	"pelotechfun/messages"
+	"time"
+)
+
+// snapshotRecord is one line of a snapshot file: a project day and its article counts. Snapshots taken before
+// projects and access methods were supported have neither, and are loaded as constants.DEFAULT_PROJECT and
+// constants.DEFAULT_ACCESS
+type snapshotRecord struct {
+	Project  string                  `json:"project,omitempty"`
+	Access   string                  `json:"access,omitempty"`
+	Day      string                  `json:"day"`
+	Articles []messages.ArticleCount `json:"articles"`
+}
+
+// Export writes the entire contents of s to w as gzip'd JSON Lines, one record per project day, and returns the number of
+// days written. The output can be loaded into any ContextStorage with Import
+func Export(ctx context.Context, s ContextStorage, w io.Writer) (int, error) {
+	zw := gzip.NewWriter(w)
+	encoder := json.NewEncoder(zw)
+	days := 0
+	var writeErr error
+	err := s.Range(ctx, func(key Key, value []messages.ArticleCount) bool {
+		writeErr = encoder.Encode(snapshotRecord{Project: key.Project, Access: key.Access, Day: key.Day.Format(constants.DATELAYOUT), Articles: value})
+		if writeErr != nil {
+			return false
+		}
+		days++
+		return true
+	})
+	if err = errors.Join(err, writeErr); err != nil {
+		zw.Close()
+		return days, err
+	}
+	return days, zw.Close()
+}
+
+// Import loads a snapshot written by Export into s, overwriting any days already present, and returns the number of
+// days loaded. Days before a malformed record are kept
+func Import(ctx context.Context, s ContextStorage, r io.Reader) (int, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, fmt.Errorf("snapshot is not gzip'd: %w", err)
+	}
+	defer zr.Close()
+	scanner := bufio.NewScanner(zr)
+	//a day of ~1000 articles is well under this, but leave headroom for imported dumps with longer lists
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	days := 0
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		record := snapshotRecord{}
+		if err = json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return days, fmt.Errorf("snapshot line %d: %w", line, err)
+		}
+		day, err := time.Parse(constants.DATELAYOUT, record.Day)
+		if err != nil {
+			return days, fmt.Errorf("snapshot line %d: bad day: %w", line, err)
+		}
+		if len(record.Project) == 0 {
+			record.Project = constants.DEFAULT_PROJECT
+		}
+		if len(record.Access) == 0 {
+			record.Access = constants.DEFAULT_ACCESS
+		}
+		if err = s.Put(ctx, NewKey(record.Project, record.Access, day), record.Articles); err != nil {
+			return days, fmt.Errorf("snapshot line %d: %w", line, err)
+		}
+		days++
+	}
+	if err = scanner.Err(); err != nil {
+		return days, fmt.Errorf("reading snapshot: %w", err)
+	}
+	return days, nil
+}
@@ -2,6 +2,8 @@
 package storage
 
 import (
+	"context"
+	"pelotechfun/constants"
 	"pelotechfun/messages"
 	"sync"
 	"time"
@@ -12,43 +14,165 @@ var (
 	TRUNCATE_TO_DAY time.Duration = (24 * time.Hour)
 )
 
+// Key identifies one cached list of article counts: the top articles of one wiki project (e.g. "en.wikipedia") on
+// one day, as seen through one access method (e.g. "all-access" or "mobile-web")
+type Key struct {
+	Project string
+	Access  string
+	Day     time.Time
+}
+
+// factory for a Key, truncating the day to midnight as every store does
+func NewKey(project string, access string, day time.Time) Key {
+	return Key{Project: project, Access: access, Day: day}.normalize()
+}
+
+// String renders the key as project/access/day, e.g. "en.wikipedia/all-access/20210101"
+func (k Key) String() string {
+	return k.Project + "/" + k.Access + "/" + k.Day.Format(constants.DATELAYOUT)
+}
+
+func (k Key) normalize() Key {
+	k.Day = k.Day.Truncate(TRUNCATE_TO_DAY)
+	return k
+}
+
 // Wrapper interface for a key-value store to allow for different backends (e.g. distributed cache, db, etc...)
 type Storage interface {
-	Put(key time.Time, value []messages.ArticleCount)
-	Get(key time.Time) ([]messages.ArticleCount, bool)
+	Put(key Key, value []messages.ArticleCount)
+	Get(key Key) ([]messages.ArticleCount, bool)
+	Delete(key Key)
+	// Range calls fn for every stored day in no particular order, stopping early if fn returns false
+	Range(fn func(key Key, value []messages.ArticleCount) bool)
+}
+
+// Version 2 of the Storage interface for backends that can fail or block (disk, network). Every call takes a context
+// so request cancellation reaches the backend, and reports failures instead of swallowing them
+type ContextStorage interface {
+	Put(ctx context.Context, key Key, value []messages.ArticleCount) error
+	// Get returns the counts for a day. Second return value will be true if the key is present
+	Get(ctx context.Context, key Key) ([]messages.ArticleCount, bool, error)
+	Delete(ctx context.Context, key Key) error
+	Has(ctx context.Context, key Key) (bool, error)
+	// Range calls fn for every stored day in no particular order, stopping early if fn returns false
+	Range(ctx context.Context, fn func(key Key, value []messages.ArticleCount) bool) error
+}
+
+// Adapt wraps an in-memory Storage so it can be used where a ContextStorage is expected. The wrapped store never
+// fails, so the only errors returned are from a cancelled or expired context
+func Adapt(s Storage) ContextStorage {
+	return &storageAdapter{s}
+}
+
+type storageAdapter struct {
+	storage Storage
+}
+
+func (t *storageAdapter) Put(ctx context.Context, key Key, value []messages.ArticleCount) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	t.storage.Put(key, value)
+	return nil
+}
+
+func (t *storageAdapter) Get(ctx context.Context, key Key) ([]messages.ArticleCount, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+	value, ok := t.storage.Get(key)
+	return value, ok, nil
+}
+
+func (t *storageAdapter) Delete(ctx context.Context, key Key) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	t.storage.Delete(key)
+	return nil
+}
+
+func (t *storageAdapter) Has(ctx context.Context, key Key) (bool, error) {
+	_, ok, err := t.Get(ctx, key)
+	return ok, err
+}
+
+// RecentTTL passes on the wrapped store's RecentTTL, if it has one
+func (t *storageAdapter) RecentTTL(key Key) (time.Duration, bool) {
+	if expiring, ok := t.storage.(recentExpirer); ok {
+		return expiring.RecentTTL(key)
+	}
+	return 0, false
+}
+
+func (t *storageAdapter) Range(ctx context.Context, fn func(key Key, value []messages.ArticleCount) bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var err error
+	t.storage.Range(func(key Key, value []messages.ArticleCount) bool {
+		if err = ctx.Err(); err != nil {
+			return false
+		}
+		return fn(key, value)
+	})
+	return err
 }
 
 // A very naive (but threadsafe!) ever growing in-memory local cache for non-prod usage.  Implements Storage interface
 type LocalMapStorage struct {
-	internal map[time.Time][]messages.ArticleCount
+	internal map[Key][]messages.ArticleCount
 	rwMutex  sync.RWMutex
 }
 
 // factory for a LocalMapStorage instance
 func NewLocalMapStorage() *LocalMapStorage {
 	return &LocalMapStorage{
-		make(map[time.Time][]messages.ArticleCount),
+		make(map[Key][]messages.ArticleCount),
 		sync.RWMutex{},
 	}
 }
 
 // Add an article day count
-func (t *LocalMapStorage) Put(key time.Time, value []messages.ArticleCount) {
-	key = key.Truncate(TRUNCATE_TO_DAY)
+func (t *LocalMapStorage) Put(key Key, value []messages.ArticleCount) {
+	key = key.normalize()
 	t.rwMutex.Lock()
 	defer t.rwMutex.Unlock()
 	t.internal[key] = value
 }
 
 // Retrieve a pointer to an article day count. Second return value will be true if the key is present
-func (t *LocalMapStorage) Get(key time.Time) ([]messages.ArticleCount, bool) {
-	key = key.Truncate(TRUNCATE_TO_DAY)
+func (t *LocalMapStorage) Get(key Key) ([]messages.ArticleCount, bool) {
+	key = key.normalize()
 	t.rwMutex.RLock()
 	defer t.rwMutex.RUnlock()
 	obj, ok := t.internal[key]
 	return obj, ok
 }
 
+// Remove an article day count if present
+func (t *LocalMapStorage) Delete(key Key) {
+	key = key.normalize()
+	t.rwMutex.Lock()
+	defer t.rwMutex.Unlock()
+	delete(t.internal, key)
+}
+
+// Visit every stored day. Works on a snapshot so fn is free to call back into the store
+func (t *LocalMapStorage) Range(fn func(key Key, value []messages.ArticleCount) bool) {
+	t.rwMutex.RLock()
+	snapshot := make(map[Key][]messages.ArticleCount, len(t.internal))
+	for key, value := range t.internal {
+		snapshot[key] = value
+	}
+	t.rwMutex.RUnlock()
+	for key, value := range snapshot {
+		if !fn(key, value) {
+			return
+		}
+	}
+}
+
 // non-exported helper function for testing
 func (t *LocalMapStorage) size() int {
 	t.rwMutex.RLock()
@@ -1,10 +1,19 @@
 package storage
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
 	"github.com/stretchr/testify/assert"
 	"math/rand"
+	"os"
+	"path/filepath"
+	"pelotechfun/constants"
 	"pelotechfun/messages"
+	"pelotechfun/storage/resptest"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -16,12 +25,377 @@ import (
 
 // Load many items concurrently then pull them out and check them
 func Test_LocalMapStorage(t *testing.T) {
-	underTest := NewLocalMapStorage()
+	verifyStorage(t, Adapt(NewLocalMapStorage()), 10000)
+}
+
+// Same checks as the map store, with fewer days to keep disk usage sane. Also verifies a fresh instance pointed at the
+// same directory sees the data, i.e. it survives a restart
+func Test_FileStorage(t *testing.T) {
+	dir := t.TempDir()
+	underTest, err := NewFileStorage(dir)
+	assert.Nil(t, err)
+	verifyStorage(t, underTest, 200)
+
+	reopened, err := NewFileStorage(dir)
+	assert.Nil(t, err)
+	day, _ := time.Parse(constants.DATELAYOUT, "20210101")
+	assert.Nil(t, underTest.Put(context.Background(), enwiki(day), []messages.ArticleCount{{Name: "Main_Page", Views: 42}}))
+	counts, found, err := reopened.Get(context.Background(), enwiki(day.Add(5*time.Hour)))
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, []messages.ArticleCount{{Name: "Main_Page", Views: 42}}, counts)
+
+	_, found, err = reopened.Get(context.Background(), enwiki(day.AddDate(-10, 0, 0)))
+	assert.Nil(t, err)
+	assert.False(t, found)
+
+	//project names must stay inside the directory
+	assert.NotNil(t, underTest.Put(context.Background(), NewKey("../escape", constants.DEFAULT_ACCESS, day), []messages.ArticleCount{}))
+}
+
+// Days cached by earlier versions, before projects and before access methods, are moved to the current layout on open
+func Test_FileStorage_MigratesLegacyLayout(t *testing.T) {
+	dir := t.TempDir()
+	day, _ := time.Parse(constants.DATELAYOUT, "20210101")
+	write := func(path string, views int) {
+		assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		bytes, _ := json.Marshal([]messages.ArticleCount{{Name: "Main_Page", Views: views}})
+		assert.Nil(t, os.WriteFile(path, bytes, 0o644))
+	}
+	write(filepath.Join(dir, "20210101.json"), 1)
+	write(filepath.Join(dir, "de.wikipedia", "20210102.json"), 2)
+	//fetched again since the upgrade, so the legacy copy is stale
+	write(filepath.Join(dir, "20210103.json"), 3)
+	write(filepath.Join(dir, "en.wikipedia", "all-access", "20210103.json"), 30)
+
+	underTest, err := NewFileStorage(dir)
+	assert.Nil(t, err)
+	ctx := context.Background()
+	for key, views := range map[Key]int{
+		enwiki(day): 1,
+		NewKey("de.wikipedia", constants.DEFAULT_ACCESS, day.AddDate(0, 0, 1)): 2,
+		enwiki(day.AddDate(0, 0, 2)): 30,
+	} {
+		counts, found, err := underTest.Get(ctx, key)
+		assert.Nil(t, err)
+		assert.True(t, found, key.String())
+		assert.Equal(t, []messages.ArticleCount{{Name: "Main_Page", Views: views}}, counts)
+	}
+	days := 0
+	assert.Nil(t, underTest.Range(ctx, func(key Key, value []messages.ArticleCount) bool {
+		days++
+		return true
+	}))
+	assert.Equal(t, 3, days)
+	legacy, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	assert.Empty(t, legacy)
+}
+
+// An unbounded BoundedStorage should behave exactly like the map store
+func Test_BoundedStorage(t *testing.T) {
+	verifyStorage(t, Adapt(NewBoundedStorage(BoundedStorageOptions{})), 10000)
+}
+
+// Least recently used days are evicted first once the day or byte limits are hit
+func Test_BoundedStorage_Eviction(t *testing.T) {
+	underTest := NewBoundedStorage(BoundedStorageOptions{MaxDays: 3})
+	day, _ := time.Parse(constants.DATELAYOUT, "20210101")
+	payload := []messages.ArticleCount{{Name: "Main_Page", Views: 1}}
+	for i := 0; i < 3; i++ {
+		underTest.Put(enwiki(day.AddDate(0, 0, i)), payload)
+	}
+	//touch the oldest day so the second one becomes the eviction candidate
+	_, found := underTest.Get(enwiki(day))
+	assert.True(t, found)
+	underTest.Put(enwiki(day.AddDate(0, 0, 3)), payload)
+	assert.Equal(t, 3, underTest.size())
+	_, found = underTest.Get(enwiki(day))
+	assert.True(t, found)
+	_, found = underTest.Get(enwiki(day.AddDate(0, 0, 1)))
+	assert.False(t, found)
+
+	//byte limit allows roughly two of these days
+	underTest = NewBoundedStorage(BoundedStorageOptions{MaxBytes: 2 * approxSize(payload)})
+	for i := 0; i < 3; i++ {
+		underTest.Put(enwiki(day.AddDate(0, 0, i)), payload)
+	}
+	assert.Equal(t, 2, underTest.size())
+	_, found = underTest.Get(enwiki(day))
+	assert.False(t, found)
+}
+
+// Recent days expire on RecentTTL, historical ones on TTL
+func Test_BoundedStorage_TTL(t *testing.T) {
+	now, _ := time.Parse(constants.DATELAYOUT, "20220601")
+	underTest := NewBoundedStorage(BoundedStorageOptions{
+		TTL:          24 * time.Hour,
+		RecentTTL:    time.Hour,
+		RecentWindow: 72 * time.Hour,
+	})
+	underTest.now = func() time.Time { return now }
+	recent := enwiki(now.AddDate(0, 0, -1))
+	historical := enwiki(now.AddDate(-1, 0, 0))
+	payload := []messages.ArticleCount{{Name: "Main_Page", Views: 1}}
+	underTest.Put(recent, payload)
+	underTest.Put(historical, payload)
+
+	now = now.Add(2 * time.Hour)
+	_, found := underTest.Get(recent)
+	assert.False(t, found)
+	_, found = underTest.Get(historical)
+	assert.True(t, found)
+
+	now = now.Add(24 * time.Hour)
+	_, found = underTest.Get(historical)
+	assert.False(t, found)
+	assert.Equal(t, 0, underTest.size())
+}
+
+// Same checks as the map store, against the in-process fake Redis
+func Test_RedisStorage(t *testing.T) {
+	server := resptest.NewServer()
+	defer server.Close()
+	underTest, err := NewRedisStorage(context.Background(), RedisOptions{Addr: server.Addr, KeyPrefix: "test:"})
+	assert.Nil(t, err)
+	verifyStorage(t, underTest, 200)
+
+	day, _ := time.Parse(constants.DATELAYOUT, "20210101")
+	payload := []messages.ArticleCount{{Name: "Main_Page", Views: 42}, {Name: "Ångström", Views: 7, Date: day}}
+	assert.Nil(t, underTest.Put(context.Background(), enwiki(day.Add(3*time.Hour)), payload))
+	assert.Equal(t, []string{"test:en.wikipedia:all-access:20210101"}, server.Keys())
+	counts, found, err := underTest.Get(context.Background(), enwiki(day))
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, payload, counts)
+
+	//a dead server surfaces as an error rather than a silent miss
+	server.Close()
+	_, _, err = underTest.Get(context.Background(), enwiki(day))
+	assert.NotNil(t, err)
+	_, err = NewRedisStorage(context.Background(), RedisOptions{Addr: server.Addr})
+	assert.NotNil(t, err)
+}
+
+// Keys written by earlier versions, before projects and before access methods, are renamed to the current layout on
+// connect
+func Test_RedisStorage_MigratesLegacyKeys(t *testing.T) {
+	server := resptest.NewServer()
+	defer server.Close()
+	ctx := context.Background()
+	seed, err := NewRedisStorage(ctx, RedisOptions{Addr: server.Addr, KeyPrefix: "test:"})
+	assert.Nil(t, err)
+	encoded := func(views int) string {
+		return string(encodeCounts([]messages.ArticleCount{{Name: "Main_Page", Views: views}}))
+	}
+	for key, views := range map[string]int{
+		"test:20210101":                         1,
+		"test:de.wikipedia:20210102":            2,
+		"test:20210103":                         3,
+		"test:en.wikipedia:all-access:20210103": 30,
+		"test:en.wikipedia:mobile-web:20210104": 4,
+		"other:20210101":                        5,
+	} {
+		_, err = seed.do(ctx, "SET", key, encoded(views))
+		assert.Nil(t, err)
+	}
+
+	underTest, err := NewRedisStorage(ctx, RedisOptions{Addr: server.Addr, KeyPrefix: "test:"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"other:20210101",
+		"test:de.wikipedia:all-access:20210102",
+		"test:en.wikipedia:all-access:20210101",
+		"test:en.wikipedia:all-access:20210103",
+		"test:en.wikipedia:mobile-web:20210104",
+	}, server.Keys())
+	day, _ := time.Parse(constants.DATELAYOUT, "20210101")
+	counts, found, err := underTest.Get(ctx, enwiki(day))
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, 1, counts[0].Views)
+	counts, _, _ = underTest.Get(ctx, enwiki(day.AddDate(0, 0, 2)))
+	assert.Equal(t, 30, counts[0].Views)
+}
+
+// Truncated or garbage values are rejected rather than decoded into nonsense
+func Test_decodeCounts_Corrupt(t *testing.T) {
+	encoded := encodeCounts([]messages.ArticleCount{{Name: "Main_Page", Views: 42}})
+	for i := 0; i < len(encoded); i++ {
+		_, err := decodeCounts(encoded[:i])
+		assert.ErrorIs(t, err, errCorruptCounts)
+	}
+	_, err := decodeCounts(append(encoded, 0))
+	assert.ErrorIs(t, err, errCorruptCounts)
+}
+
+// Same checks as the map store for a memory tier in front of a file tier
+func Test_TieredStorage(t *testing.T) {
+	cold, err := NewFileStorage(t.TempDir())
+	assert.Nil(t, err)
+	verifyStorage(t, NewTieredStorage(Tier{"memory", Adapt(NewLocalMapStorage())}, Tier{"file", cold}), 200)
+}
+
+// Reads fall through to slower tiers and promote what they find; a broken tier is skipped
+func Test_TieredStorage_Promotion(t *testing.T) {
+	ctx := context.Background()
+	hot := NewLocalMapStorage()
+	cold := Adapt(NewLocalMapStorage())
+	underTest := NewTieredStorage(Tier{"hot", Adapt(hot)}, Tier{"cold", cold})
+	day, _ := time.Parse(constants.DATELAYOUT, "20210101")
+	payload := []messages.ArticleCount{{Name: "Main_Page", Views: 42}}
+	assert.Nil(t, cold.Put(ctx, enwiki(day), payload))
+
+	counts, found, err := underTest.Get(ctx, enwiki(day))
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, payload, counts)
+	promoted, found := hot.Get(enwiki(day))
+	assert.True(t, found)
+	assert.Equal(t, payload, promoted)
+
+	//a dead middle tier doesn't stop the cold tier answering, but is reported if nothing is found
+	server := resptest.NewServer()
+	broken, err := NewRedisStorage(ctx, RedisOptions{Addr: server.Addr})
+	assert.Nil(t, err)
+	server.Close()
+	underTest = NewTieredStorage(Tier{"hot", Adapt(NewLocalMapStorage())}, Tier{"redis", broken}, Tier{"cold", cold})
+	counts, found, err = underTest.Get(ctx, enwiki(day))
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, payload, counts)
+	_, found, err = underTest.Get(ctx, enwiki(day.AddDate(0, 0, 1)))
+	assert.False(t, found)
+	var tierErr *TierError
+	assert.ErrorAs(t, err, &tierErr)
+	assert.Equal(t, "redis", tierErr.Tier)
+}
+
+// A recent day's TTL covers the whole stack: once it passes the persistent tier's copy is a miss too, and reads from
+// it don't restart the TTL by promoting the day
+func Test_TieredStorage_RecentTTL(t *testing.T) {
+	ctx := context.Background()
+	now, _ := time.Parse(constants.DATELAYOUT, "20220601")
+	clock := func() time.Time { return now }
+	hot := NewBoundedStorage(BoundedStorageOptions{RecentTTL: time.Hour, RecentWindow: 72 * time.Hour})
+	hot.now = clock
+	cold, err := NewFileStorage(t.TempDir())
+	assert.Nil(t, err)
+	underTest := NewTieredStorage(Tier{"bounded", Adapt(hot)}, Tier{"file", cold})
+	underTest.now = clock
+	recent := enwiki(now.AddDate(0, 0, -1))
+	historical := enwiki(now.AddDate(-1, 0, 0))
+	payload := []messages.ArticleCount{{Name: "Main_Page", Views: 1}}
+	assert.Nil(t, underTest.Put(ctx, recent, payload))
+	assert.Nil(t, underTest.Put(ctx, historical, payload))
+
+	//within the TTL the persistent copy is served but not promoted
+	hot.Delete(recent)
+	hot.Delete(historical)
+	now = now.Add(30 * time.Minute)
+	_, found, err := underTest.Get(ctx, recent)
+	assert.Nil(t, err)
+	assert.True(t, found)
+	_, found = hot.Get(recent)
+	assert.False(t, found)
+	_, found, _ = underTest.Get(ctx, historical)
+	assert.True(t, found)
+	_, found = hot.Get(historical)
+	assert.True(t, found)
+
+	now = now.Add(time.Hour)
+	_, found, err = underTest.Get(ctx, recent)
+	assert.Nil(t, err)
+	assert.False(t, found)
+	found, _ = underTest.Has(ctx, recent)
+	assert.False(t, found)
+	assert.Nil(t, underTest.Range(ctx, func(key Key, value []messages.ArticleCount) bool {
+		assert.NotEqual(t, recent, key)
+		return true
+	}))
+
+	//a store opened later doesn't know when the persistent copy was written, so doesn't trust it
+	restarted := NewTieredStorage(Tier{"bounded", Adapt(hot)}, Tier{"file", cold})
+	restarted.now = clock
+	assert.Nil(t, cold.Put(ctx, recent, payload))
+	_, found, _ = restarted.Get(ctx, recent)
+	assert.False(t, found)
+}
+
+// A snapshot exported from one backend loads into another with identical contents
+func Test_Snapshot_RoundTrip(t *testing.T) {
+	ctx := context.Background()
+	source := Adapt(NewLocalMapStorage())
+	day, _ := time.Parse(constants.DATELAYOUT, "20210101")
+	for i := 0; i < 30; i++ {
+		payload := []messages.ArticleCount{{Name: "Main_Page", Views: i}, {Name: "Special:Search", Views: 2 * i}}
+		assert.Nil(t, source.Put(ctx, enwiki(day.AddDate(0, 0, i)), payload))
+	}
+	assert.Nil(t, source.Put(ctx, NewKey("de.wikipedia", constants.ACCESS_MOBILE_APP, day), []messages.ArticleCount{{Name: "Wikipedia:Hauptseite", Views: 7}}))
+	buf := bytes.Buffer{}
+	exported, err := Export(ctx, source, &buf)
+	assert.Nil(t, err)
+	assert.Equal(t, 31, exported)
+
+	target, err := NewFileStorage(t.TempDir())
+	assert.Nil(t, err)
+	imported, err := Import(ctx, target, &buf)
+	assert.Nil(t, err)
+	assert.Equal(t, 31, imported)
+	for i := 0; i < 30; i++ {
+		counts, found, err := target.Get(ctx, enwiki(day.AddDate(0, 0, i)))
+		assert.Nil(t, err)
+		assert.True(t, found)
+		assert.Equal(t, 2*i, counts[1].Views)
+	}
+	counts, found, err := target.Get(ctx, NewKey("de.wikipedia", constants.ACCESS_MOBILE_APP, day))
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, 7, counts[0].Views)
+
+	//snapshots from before projects existed load as the default project
+	buf.Reset()
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(`{"day":"20200101","articles":[{"name":"Main_Page","views":3}]}` + "\n"))
+	zw.Close()
+	imported, err = Import(ctx, target, &buf)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, imported)
+	_, found, err = target.Get(ctx, enwiki(day.AddDate(-1, 0, 0)))
+	assert.Nil(t, err)
+	assert.True(t, found)
+
+	_, err = Import(ctx, target, strings.NewReader("not gzip"))
+	assert.NotNil(t, err)
+}
+
+// The adapter refuses to touch the wrapped store once the context is done
+func Test_Adapt_Cancelled(t *testing.T) {
+	inner := NewLocalMapStorage()
+	underTest := Adapt(inner)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	day, _ := time.Parse(constants.DATELAYOUT, "20210101")
+	assert.ErrorIs(t, underTest.Put(ctx, enwiki(day), []messages.ArticleCount{}), context.Canceled)
+	_, _, err := underTest.Get(ctx, enwiki(day))
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.ErrorIs(t, underTest.Range(ctx, func(Key, []messages.ArticleCount) bool { return true }), context.Canceled)
+	assert.Equal(t, 0, inner.size())
+}
+
+// enwiki keys a day under the default project
+func enwiki(day time.Time) Key {
+	return NewKey(constants.DEFAULT_PROJECT, constants.DEFAULT_ACCESS, day)
+}
+
+// verifyStorage loads the given number of days concurrently, then checks every one of them can be read back. Days
+// are spread over several projects and access methods to check they don't collide
+func verifyStorage(t *testing.T, underTest ContextStorage, days int) {
+	ctx := context.Background()
 	wg := sync.WaitGroup{}
 	now := time.Now()
-	future := now.AddDate(00, 0, 10000)
-	var dateMap = map[time.Time][]messages.ArticleCount{}
-	for d := now; d.Before(future) == true; d = d.AddDate(0, 0, 1) {
+	var dateMap = map[Key][]messages.ArticleCount{}
+	for i := 0; len(dateMap) < days; i++ {
+		d := NewKey([]string{"en.wikipedia", "de.wikipedia"}[i%2], []string{"all-access", "desktop", "mobile-web"}[i%3], now.AddDate(0, 0, i/6))
 		wg.Add(1)
 
 		payload := make([]messages.ArticleCount, 1000)
@@ -30,17 +404,34 @@ func Test_LocalMapStorage(t *testing.T) {
 			countobj.Views = rand.Intn(100)
 		}
 		dateMap[d] = payload
-		go func(key time.Time) {
+		go func(key Key) {
 			defer wg.Done()
-			underTest.Put(key, payload)
+			assert.Nil(t, underTest.Put(ctx, key, payload))
 		}(d)
 	}
 	wg.Wait()
 
+	//every key should come back exactly once when ranging over the store
+	ranged := 0
+	assert.Nil(t, underTest.Range(ctx, func(key Key, value []messages.ArticleCount) bool {
+		ranged++
+		assert.Equal(t, 1000, len(value))
+		return true
+	}))
+	assert.Equal(t, len(dateMap), ranged)
+
 	//spin through the map of sent keys and verify there is an object there for it and that the views match
 	for datekey := range dateMap {
-		_, found := underTest.Get(datekey)
+		_, found, err := underTest.Get(ctx, datekey)
+		assert.Nil(t, err)
 		assert.True(t, found)
+		has, err := underTest.Has(ctx, datekey)
+		assert.Nil(t, err)
+		assert.True(t, has)
+		assert.Nil(t, underTest.Delete(ctx, datekey))
+		has, err = underTest.Has(ctx, datekey)
+		assert.Nil(t, err)
+		assert.False(t, has)
 		delete(dateMap, datekey)
 	}
 	assert.Equal(t, 0, len(dateMap))
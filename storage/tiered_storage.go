@@ -0,0 +1,217 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"pelotechfun/messages"
+	"sync"
+	"time"
+)
+
+var (
+	tierHitsCounter, _ = Meter.Int64Counter(
+		"storage_tier_hits",
+		metric.WithUnit("1"),
+		metric.WithDescription("number of day lookups served by each tier of a tiered store"),
+	)
+	tierMissesCounter, _ = Meter.Int64Counter(
+		"storage_tier_misses",
+		metric.WithUnit("1"),
+		metric.WithDescription("number of day lookups each tier of a tiered store could not serve"),
+	)
+)
+
+// A named layer of a TieredStorage. The name is used as the "tier" attribute on metrics
+type Tier struct {
+	Name    string
+	Storage ContextStorage
+}
+
+// A store composed of tiers ordered fastest first, e.g. a small in-memory cache in front of redis or files. Reads
+// try each tier in turn and promote a hit into the faster tiers above it; writes go through to every tier. A failing
+// tier is logged and skipped rather than failing the call. A recent day's TTL applies to the whole stack: tiers
+// without one only serve the day until the TTL of its last Put has passed, and it is never promoted, which would
+// restart the TTL. Implements ContextStorage interface
+type TieredStorage struct {
+	tiers []Tier
+	// fresh holds when each recent day Put through the stack expires
+	fresh map[Key]time.Time
+	mutex sync.Mutex
+	now   func() time.Time
+}
+
+// Type recentExpirer is implemented by stores that expire recent days after their own TTL, such as BoundedStorage
+type recentExpirer interface {
+	// RecentTTL reports the TTL a day is kept for if it is recent
+	RecentTTL(key Key) (time.Duration, bool)
+}
+
+// factory for a TieredStorage instance
+func NewTieredStorage(tiers ...Tier) *TieredStorage {
+	return &TieredStorage{tiers: tiers, fresh: make(map[Key]time.Time), now: time.Now}
+}
+
+// Add an article day count to every tier
+func (t *TieredStorage) Put(ctx context.Context, key Key, value []messages.ArticleCount) error {
+	if ttl, recent := t.recentTTL(key); recent {
+		t.mutex.Lock()
+		now := t.now()
+		for freshKey, expires := range t.fresh {
+			if !now.Before(expires) {
+				delete(t.fresh, freshKey)
+			}
+		}
+		t.fresh[key.normalize()] = now.Add(ttl)
+		t.mutex.Unlock()
+	}
+	var errs []error
+	for _, tier := range t.tiers {
+		if err := tier.Storage.Put(ctx, key, value); err != nil {
+			errs = append(errs, t.tierError(tier, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Retrieve an article day count from the fastest tier that has it, copying it into the tiers above unless it is
+// recent. Errors are only returned if no tier had the day
+func (t *TieredStorage) Get(ctx context.Context, key Key) ([]messages.ArticleCount, bool, error) {
+	_, recent := t.recentTTL(key)
+	var errs []error
+	for i, tier := range t.tiers {
+		if !t.serves(tier, key) {
+			continue
+		}
+		value, ok, err := tier.Storage.Get(ctx, key)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, false, ctx.Err()
+			}
+			log.Warnf("Storage tier %s failed to read %s: %v", tier.Name, key, err)
+			errs = append(errs, t.tierError(tier, err))
+			continue
+		}
+		attributes := metric.WithAttributes(attribute.String("tier", tier.Name))
+		if !ok {
+			tierMissesCounter.Add(ctx, 1, attributes)
+			continue
+		}
+		tierHitsCounter.Add(ctx, 1, attributes)
+		if recent {
+			return value, true, nil
+		}
+		for _, faster := range t.tiers[:i] {
+			if err = faster.Storage.Put(ctx, key, value); err != nil {
+				log.Warnf("Storage tier %s failed to promote %s: %v", faster.Name, key, err)
+			}
+		}
+		return value, true, nil
+	}
+	return nil, false, errors.Join(errs...)
+}
+
+// Remove an article day count from every tier
+func (t *TieredStorage) Delete(ctx context.Context, key Key) error {
+	var errs []error
+	for _, tier := range t.tiers {
+		if err := tier.Storage.Delete(ctx, key); err != nil {
+			errs = append(errs, t.tierError(tier, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Check whether any tier has an article day count
+func (t *TieredStorage) Has(ctx context.Context, key Key) (bool, error) {
+	var errs []error
+	for _, tier := range t.tiers {
+		if !t.serves(tier, key) {
+			continue
+		}
+		ok, err := tier.Storage.Has(ctx, key)
+		if err != nil {
+			errs = append(errs, t.tierError(tier, err))
+			continue
+		}
+		if ok {
+			return true, nil
+		}
+	}
+	return false, errors.Join(errs...)
+}
+
+// Visit every day held by any tier once, preferring the fastest tier's copy
+func (t *TieredStorage) Range(ctx context.Context, fn func(key Key, value []messages.ArticleCount) bool) error {
+	//tiers may hand back the same day in different locations, so dedupe on the formatted key
+	seen := make(map[string]bool)
+	stopped := false
+	for _, tier := range t.tiers {
+		err := tier.Storage.Range(ctx, func(key Key, value []messages.ArticleCount) bool {
+			day := key.String()
+			if seen[day] || !t.serves(tier, key) {
+				return true
+			}
+			seen[day] = true
+			stopped = !fn(key, value)
+			return !stopped
+		})
+		if err != nil {
+			return t.tierError(tier, err)
+		}
+		if stopped {
+			return nil
+		}
+	}
+	return nil
+}
+
+// recentTTL reports the shortest TTL any tier keeps key for if it is a recent day
+func (t *TieredStorage) recentTTL(key Key) (time.Duration, bool) {
+	shortest, recent := time.Duration(0), false
+	for _, tier := range t.tiers {
+		if expiring, ok := tier.Storage.(recentExpirer); ok {
+			if ttl, ok := expiring.RecentTTL(key); ok && (!recent || ttl < shortest) {
+				shortest, recent = ttl, true
+			}
+		}
+	}
+	return shortest, recent
+}
+
+// serves reports whether tier may answer for key. Tiers expiring a recent day themselves always may; the others only
+// until the day's TTL has passed, and not at all for a day this store didn't Put, e.g. one left from before a restart
+func (t *TieredStorage) serves(tier Tier, key Key) bool {
+	if expiring, ok := tier.Storage.(recentExpirer); ok {
+		if _, recent := expiring.RecentTTL(key); recent {
+			return true
+		}
+	}
+	if _, recent := t.recentTTL(key); !recent {
+		return true
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	expires, ok := t.fresh[key.normalize()]
+	return ok && t.now().Before(expires)
+}
+
+func (t *TieredStorage) tierError(tier Tier, err error) error {
+	return &TierError{Tier: tier.Name, Err: err}
+}
+
+// Error type identifying which tier of a TieredStorage failed
+type TierError struct {
+	Tier string
+	Err  error
+}
+
+func (e *TierError) Error() string {
+	return "storage tier " + e.Tier + ": " + e.Err.Error()
+}
+
+func (e *TierError) Unwrap() error {
+	return e.Err
+}